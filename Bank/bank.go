@@ -4,9 +4,13 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -24,6 +28,29 @@ type bankInfo struct {
 	BankChargesWalletID   string
 	BankLiabilityWalletID string
 	TDSreceivableWalletID string
+	WalletIDs             map[string]string // wallet role -> walletID, as per the bank wallet template
+	Version               int
+	LastModifiedBy        string
+	LastModifiedAt        time.Time
+}
+
+// bankInfoVersion is one entry of getBankInfoHistory
+type bankInfoVersion struct {
+	TxnID     string
+	Timestamp time.Time
+	IsDelete  bool
+	BankInfo  bankInfo
+}
+
+// walletTemplate is returned by getWalletTemplate in walletcc
+type walletTemplate struct {
+	EntityType string
+	Wallets    []templateWallet
+}
+
+type templateWallet struct {
+	WalletRole string
+	OpeningBal int64
 }
 
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
@@ -39,6 +66,10 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return getBankInfo(stub, args)
 	} else if function == "getWalletID" {
 		return getWalletID(stub, args)
+	} else if function == "updateBankInfo" {
+		return updateBankInfo(stub, args)
+	} else if function == "getBankInfoHistory" {
+		return getBankInfoHistory(stub, args)
 	}
 	return shim.Error("No function named " + function + " in Bank")
 
@@ -51,66 +82,233 @@ func writeBankInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error("Invalid number of arguments in writeBankInfo (required:9) given:" + xLenStr)
 	}
 
-	hash := sha256.New()
-
-	// Hashing bankWalletId
-	BankWalletStr := args[3] + "BankWallet"
-	hash.Write([]byte(BankWalletStr))
-	md := hash.Sum(nil)
-	BankWalletIDsha := hex.EncodeToString(md)
-	createWallet(stub, BankWalletIDsha, "1000")
-
-	// Hashing bankAssetWalletId
-	BankAssetWalletStr := args[3] + "BankAssetWallet"
-	hash.Write([]byte(BankAssetWalletStr))
-	md = hash.Sum(nil)
-	BankAssetWalletIDsha := hex.EncodeToString(md)
-	createWallet(stub, BankAssetWalletIDsha, "1000")
-
-	// Hashing BankChargesWalletID
-	BankChargesWalletStr := args[3] + "BankChargesWallet"
-	hash.Write([]byte(BankChargesWalletStr))
-	md = hash.Sum(nil)
-	BankChargesWalletIDsha := hex.EncodeToString(md)
-	createWallet(stub, BankChargesWalletIDsha, "1000")
-
-	// Hashing BankLiabilityWalletID
-	BankLiabilityWalletStr := args[3] + "BankLiabilityWallet"
-	hash.Write([]byte(BankLiabilityWalletStr))
-	md = hash.Sum(nil)
-	BankLiabilityWalletIDsha := hex.EncodeToString(md)
-	createWallet(stub, BankLiabilityWalletIDsha, "1000")
-
-	// Hashing TDSreceivableWalletID
-	TDSreceivableWalletStr := args[3] + "TDSreceivableWallet"
-	hash.Write([]byte(TDSreceivableWalletStr))
-	md = hash.Sum(nil)
-	TDSreceivableWalletIDsha := hex.EncodeToString(md)
-	createWallet(stub, TDSreceivableWalletIDsha, "1000")
+	ifExists, err := stub.GetState(args[0])
+	if ifExists != nil {
+		fmt.Println(ifExists)
+		return shim.Error("BankId " + args[0] + " exits. Cannot create new ID")
+	}
+
+	walletIDs, err := createWallets(stub, args[0], args[3])
+	if err != nil {
+		return shim.Error("Unable to create the bank wallets: " + err.Error())
+	}
+
+	modifiedBy, modifiedAt, err := modifiedByAndAt(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	//args[0] -> bankID
-	bank := bankInfo{args[1], args[2], args[3], BankWalletIDsha, BankAssetWalletIDsha, BankChargesWalletIDsha, BankLiabilityWalletIDsha, TDSreceivableWalletIDsha}
+	bank := bankInfo{args[1], args[2], args[3], walletIDs["main"], walletIDs["asset"], walletIDs["charges"], walletIDs["liability"], walletIDs["tds"], walletIDs, 1, modifiedBy, modifiedAt}
 	bankBytes, err := json.Marshal(bank)
 	if err != nil {
 		return shim.Error("Unable to Marshal the json file " + err.Error())
 	}
 
-	ifExists, err := stub.GetState(args[0])
-	if ifExists != nil {
-		fmt.Println(ifExists)
-		return shim.Error("BankId " + args[0] + " exits. Cannot create new ID")
+	err = stub.PutState(args[0], bankBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Succefully written into the ledger"))
+}
+
+func updateBankInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> bankID
+	*args[1],args[2] ... -> pairs of field name and new value
+	*
+	*Fields that can be changed: BankName, BankBranch
+	*Bankcode cannot be changed, the wallet IDs of the bank are hashed from it.
+	*The caller needs the bankID attribute of the bank, or role=admin
+	 */
+	if len(args) < 3 || len(args)%2 != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in updateBankInfo (required: bankID followed by field,value pairs) given:" + xLenStr)
+	}
+	err := checkBankCaller(stub, args[0], "update")
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
+	bankInfoBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error("Unable to fetch the state" + err.Error())
+	}
+	if bankInfoBytes == nil {
+		return shim.Error("Data does not exist for " + args[0])
+	}
+	bank := bankInfo{}
+	err = json.Unmarshal(bankInfoBytes, &bank)
+	if err != nil {
+		return shim.Error("Uable to paser into the json format")
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		if args[i+1] == "" {
+			return shim.Error("Empty value for " + args[i] + " in updateBankInfo")
+		}
+		switch args[i] {
+		case "BankName":
+			bank.BankName = args[i+1]
+		case "BankBranch":
+			bank.BankBranch = args[i+1]
+		case "Bankcode":
+			if args[i+1] != bank.Bankcode {
+				return shim.Error("Bankcode of bank " + args[0] + " cannot be changed, the wallet IDs of the bank are hashed from it")
+			}
+		default:
+			return shim.Error("Field " + args[i] + " cannot be updated in updateBankInfo")
+		}
+	}
+
+	// banks written before versioning are taken as version 1
+	if bank.Version == 0 {
+		bank.Version = 1
+	}
+	bank.Version++
+	bank.LastModifiedBy, bank.LastModifiedAt, err = modifiedByAndAt(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bankBytes, err := json.Marshal(bank)
+	if err != nil {
+		return shim.Error("Unable to Marshal the json file " + err.Error())
+	}
 	err = stub.PutState(args[0], bankBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Bank " + args[0] + " updated to version " + strconv.Itoa(bank.Version)))
+}
 
-	return shim.Success([]byte("Succefully written into the ledger"))
+func getBankInfoHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getBankInfoHistory (required:1) given:" + xLenStr)
+	}
+
+	historyIterator, err := stub.GetHistoryForKey(args[0])
+	if err != nil {
+		return shim.Error("Unable to get the history of " + args[0] + ": " + err.Error())
+	}
+	defer historyIterator.Close()
+
+	versions := []bankInfoVersion{}
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+		if err != nil {
+			return shim.Error("Unable to iterate historyIterator:" + err.Error())
+		}
+		version := bankInfoVersion{TxnID: modification.TxId, IsDelete: modification.IsDelete}
+		if modification.Timestamp != nil {
+			version.Timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC()
+		}
+		if !modification.IsDelete {
+			err = json.Unmarshal(modification.Value, &version.BankInfo)
+			if err != nil {
+				return shim.Error("Unable to parse the bank history of " + args[0] + ": " + err.Error())
+			}
+		}
+		versions = append(versions, version)
+	}
+	if len(versions) == 0 {
+		return shim.Error("Data does not exist for " + args[0])
+	}
+
+	versionsBytes, err := json.Marshal(versions)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(versionsBytes)
 }
 
-func createWallet(stub shim.ChaincodeStubInterface, walletID string, amt string) pb.Response {
-	chaincodeArgs := toChaincodeArgs("newWallet", walletID, amt)
+// checkBankCaller fails unless the caller has the bankID attribute of the
+// bank, or role=admin, in its certificate. action says what the caller tried
+// to do.
+func checkBankCaller(stub shim.ChaincodeStubInterface, bankID string, action string) error {
+	callerBankID, bankFound, err := cid.GetAttributeValue(stub, "bankID")
+	if err != nil {
+		return errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+	role, roleFound, err := cid.GetAttributeValue(stub, "role")
+	if err != nil {
+		return errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+	if !(bankFound && callerBankID == bankID) && !(roleFound && role == "admin") {
+		return errors.New("Only the bank " + bankID + " or an admin can " + action + " it")
+	}
+	return nil
+}
+
+// modifiedByAndAt returns the identity of the caller and the transaction time
+func modifiedByAndAt(stub shim.ChaincodeStubInterface) (string, time.Time, error) {
+	modifiedBy, err := cid.GetID(stub)
+	if err != nil {
+		return "", time.Time{}, errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return "", time.Time{}, errors.New("Unable to get the transaction timestamp: " + err.Error())
+	}
+	return modifiedBy, time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// createWallets creates a wallet for every role in the bank wallet template of
+// walletcc and returns the walletIDs by role
+func createWallets(stub shim.ChaincodeStubInterface, bankID string, bankCode string) (map[string]string, error) {
+	chaincodeArgs := toChaincodeArgs("getWalletTemplate", "bank")
+	response := stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return nil, errors.New(response.Message)
+	}
+	template := walletTemplate{}
+	err := json.Unmarshal(response.Payload, &template)
+	if err != nil {
+		return nil, errors.New("Unable to parse the bank wallet template " + err.Error())
+	}
+
+	walletIDs := map[string]string{}
+	for _, wallet := range template.Wallets {
+		if wallet.WalletRole == "" {
+			return nil, errors.New("Empty wallet role in the bank wallet template")
+		}
+		// Hashing the walletId from the bank code and the role
+		md := sha256.Sum256([]byte(bankCode + bankWalletSuffix(wallet.WalletRole)))
+		walletID := hex.EncodeToString(md[:])
+
+		response = createWallet(stub, walletID, strconv.FormatInt(wallet.OpeningBal, 10), bankID, wallet.WalletRole)
+		if response.Status != shim.OK {
+			return nil, errors.New(response.Message)
+		}
+		walletIDs[wallet.WalletRole] = walletID
+	}
+	return walletIDs, nil
+}
+
+// bankWalletSuffix names the wallet of a role in the hash input. The names
+// follow the ones used before wallet templates, but only the main wallet ID
+// comes out the same: the old code fed every name into one running hash, so
+// each later wallet ID hashed all the names before it.
+// createWallets makes sure walletRole is not empty.
+func bankWalletSuffix(walletRole string) string {
+	switch walletRole {
+	case "main":
+		return "BankWallet"
+	case "tds":
+		return "TDSreceivableWallet"
+	}
+	return "Bank" + strings.ToUpper(walletRole[:1]) + walletRole[1:] + "Wallet"
+}
+
+func createWallet(stub shim.ChaincodeStubInterface, walletID string, amt string, ownerID string, walletRole string) pb.Response {
+	chaincodeArgs := toChaincodeArgs("newWallet", walletID, amt, "bank", ownerID, walletRole)
 	response := stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
 	if response.Status != shim.OK {
-		return shim.Error("Unable to create new wallet from bank")
+		return shim.Error("Unable to create new wallet from bank: " + response.Message)
 	}
 	return shim.Success([]byte("created new wallet from bank"))
 }
@@ -144,9 +342,11 @@ func getBankInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if err != nil {
 		return shim.Error("Uable to paser into the json format")
 	}
-	x := fmt.Sprintf("%+v", bank)
-	fmt.Printf("BankInfo : %s\n", x)
-	return shim.Success(nil)
+	bankBytes, err := json.Marshal(bank)
+	if err != nil {
+		return shim.Error("Unable to Marshal the json file " + err.Error())
+	}
+	return shim.Success(bankBytes)
 }
 
 func getWalletID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -168,18 +368,25 @@ func getWalletID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	}
 
 	walletID := ""
-
-	switch args[1] {
-	case "main":
-		walletID = bank.BankWalletID
-	case "asset":
-		walletID = bank.BankAssetWalletID
-	case "charges":
-		walletID = bank.BankChargesWalletID
-	case "liability":
-		walletID = bank.BankLiabilityWalletID
-	case "tds":
-		walletID = bank.TDSreceivableWalletID
+	if bank.WalletIDs != nil {
+		walletID = bank.WalletIDs[args[1]]
+	} else {
+		// banks written before wallet templates
+		switch args[1] {
+		case "main":
+			walletID = bank.BankWalletID
+		case "asset":
+			walletID = bank.BankAssetWalletID
+		case "charges":
+			walletID = bank.BankChargesWalletID
+		case "liability":
+			walletID = bank.BankLiabilityWalletID
+		case "tds":
+			walletID = bank.TDSreceivableWalletID
+		}
+	}
+	if walletID == "" {
+		return shim.Error("No " + args[1] + " wallet for bank " + args[0])
 	}
 
 	return shim.Success([]byte(walletID))
@@ -4,11 +4,14 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
 )
 
 type chainCode struct {
@@ -25,6 +28,29 @@ type businessInfo struct {
 	MinROI                    float64
 	NumberOfPrograms          int
 	BusinessExposure          int64
+	WalletIDs                 map[string]string // wallet role -> walletID, as per the business wallet template
+	LimitUtilised             int64             // disbursed and not yet collected
+	LimitBlocked              int64             // sanctioned and not yet disbursed
+}
+
+// businessLimitStatus is returned by getBusinessLimitStatus
+type businessLimitStatus struct {
+	BusinessLimit    int64
+	Utilised         int64
+	Blocked          int64
+	Available        int64
+	BusinessExposure int64
+}
+
+// walletTemplate is returned by getWalletTemplate in walletcc
+type walletTemplate struct {
+	EntityType string
+	Wallets    []templateWallet
+}
+
+type templateWallet struct {
+	WalletRole string
+	OpeningBal int64
 }
 
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
@@ -40,6 +66,14 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return getBusinessInfo(stub, args)
 	} else if function == "getWalletID" {
 		return getWalletID(stub, args)
+	} else if function == "reserveLimit" {
+		return reserveLimit(stub, args)
+	} else if function == "drawLimit" {
+		return drawLimit(stub, args)
+	} else if function == "releaseLimit" {
+		return releaseLimit(stub, args)
+	} else if function == "getBusinessLimitStatus" {
+		return getBusinessLimitStatus(stub, args)
 	}
 	return shim.Error("No function named " + function + " in Business")
 }
@@ -57,29 +91,6 @@ func putNewBusinessInfo(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 		return shim.Error(err.Error())
 	}
 
-	hash := sha256.New()
-
-	// Hashing BusinessWalletID
-	BusinessWalletStr := args[2] + "BusinessWallet"
-	hash.Write([]byte(BusinessWalletStr))
-	md := hash.Sum(nil)
-	BusinessWalletIDsha := hex.EncodeToString(md)
-	createWallet(stub, BusinessWalletIDsha, "1000")
-
-	// Hashing BusinessLoanWalletID
-	BusinessLoanWalletStr := args[2] + "BusinessLoanWallet"
-	hash.Write([]byte(BusinessLoanWalletStr))
-	md = hash.Sum(nil)
-	BusinessLoanWalletIDsha := hex.EncodeToString(md)
-	createWallet(stub, BusinessLoanWalletIDsha, "1000")
-
-	// Hashing BusinessLiabilityWalletID
-	BusinessLiabilityWalletStr := args[2] + "BusinessLiabilityWallet"
-	hash.Write([]byte(BusinessLiabilityWalletStr))
-	md = hash.Sum(nil)
-	BusinessLiabilityWalletIDsha := hex.EncodeToString(md)
-	createWallet(stub, BusinessLiabilityWalletIDsha, "1000")
-
 	maxROIconvertion, err := strconv.ParseFloat(args[7], 32)
 	if err != nil {
 		fmt.Printf("Invalid Maximum ROI: %s\n", args[7])
@@ -108,7 +119,12 @@ func putNewBusinessInfo(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 		return shim.Error("BusinessId " + args[0] + " exits. Cannot create new ID")
 	}
 
-	newInfo := &businessInfo{args[1], args[2], businessLimitConv, BusinessWalletIDsha, BusinessLoanWalletIDsha, BusinessLiabilityWalletIDsha, maxROIconvertion, minROIconvertion, numOfPrograms, businessExposureConv}
+	walletIDs, err := createWallets(stub, args[0], args[2], businessLimitConv)
+	if err != nil {
+		return shim.Error("Unable to create the business wallets: " + err.Error())
+	}
+
+	newInfo := &businessInfo{args[1], args[2], businessLimitConv, walletIDs["main"], walletIDs["loan"], walletIDs["liability"], maxROIconvertion, minROIconvertion, numOfPrograms, businessExposureConv, walletIDs, 0, 0}
 	newInfoBytes, _ := json.Marshal(newInfo)
 	err = stub.PutState(args[0], newInfoBytes) // businessID = args[0]
 	if err != nil {
@@ -117,11 +133,62 @@ func putNewBusinessInfo(stub shim.ChaincodeStubInterface, args []string) pb.Resp
 	return shim.Success(nil)
 }
 
-func createWallet(stub shim.ChaincodeStubInterface, walletID string, amt string) pb.Response {
-	chaincodeArgs := toChaincodeArgs("newWallet", walletID, amt)
+// createWallets creates a wallet for every role in the business wallet template
+// of walletcc and returns the walletIDs by role. The loan wallet carries the
+// debt of the business as a negative balance, and the liability wallet what
+// it owes on the instruments it was paid early in an AP program, so both can
+// be overdrawn up to the business limit.
+func createWallets(stub shim.ChaincodeStubInterface, businessID string, businessAcNo string, businessLimit int64) (map[string]string, error) {
+	chaincodeArgs := toChaincodeArgs("getWalletTemplate", "business")
+	response := stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return nil, errors.New(response.Message)
+	}
+	template := walletTemplate{}
+	err := json.Unmarshal(response.Payload, &template)
+	if err != nil {
+		return nil, errors.New("Unable to parse the business wallet template " + err.Error())
+	}
+
+	walletIDs := map[string]string{}
+	for _, wallet := range template.Wallets {
+		if wallet.WalletRole == "" {
+			return nil, errors.New("Empty wallet role in the business wallet template")
+		}
+		// Hashing the walletId from the business account number and the role
+		md := sha256.Sum256([]byte(businessAcNo + businessWalletSuffix(wallet.WalletRole)))
+		walletID := hex.EncodeToString(md[:])
+
+		var overdraft int64
+		if wallet.WalletRole == "loan" || wallet.WalletRole == "liability" {
+			overdraft = businessLimit
+		}
+		response = createWallet(stub, walletID, strconv.FormatInt(wallet.OpeningBal, 10), businessID, wallet.WalletRole, strconv.FormatInt(overdraft, 10))
+		if response.Status != shim.OK {
+			return nil, errors.New(response.Message)
+		}
+		walletIDs[wallet.WalletRole] = walletID
+	}
+	return walletIDs, nil
+}
+
+// businessWalletSuffix names the wallet of a role in the hash input. The
+// names follow the ones used before wallet templates, but only the main
+// wallet ID comes out the same: the old code fed every name into one running
+// hash, so each later wallet ID hashed all the names before it.
+// createWallets makes sure walletRole is not empty.
+func businessWalletSuffix(walletRole string) string {
+	if walletRole == "main" {
+		return "BusinessWallet"
+	}
+	return "Business" + strings.ToUpper(walletRole[:1]) + walletRole[1:] + "Wallet"
+}
+
+func createWallet(stub shim.ChaincodeStubInterface, walletID string, amt string, ownerID string, walletRole string, overdraft string) pb.Response {
+	chaincodeArgs := toChaincodeArgs("newWallet", walletID, amt, "business", ownerID, walletRole, overdraft)
 	response := stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
 	if response.Status != shim.OK {
-		return shim.Error("Unable to create new wallet from business")
+		return shim.Error("Unable to create new wallet from business: " + response.Message)
 	}
 	return shim.Success([]byte("created new wallet from business"))
 }
@@ -153,9 +220,11 @@ func getBusinessInfo(stub shim.ChaincodeStubInterface, args []string) pb.Respons
 	if err != nil {
 		return shim.Error("Unable to parse businessInfo into the structure " + err.Error())
 	}
-	jsonString := fmt.Sprintf("%+v", parsedBusinessInfo)
-	fmt.Printf("Business Info: %s\n", jsonString)
-	return shim.Success(nil)
+	businessBytes, err := json.Marshal(parsedBusinessInfo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(businessBytes)
 }
 
 func getWalletID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -179,19 +248,248 @@ func getWalletID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	}
 
 	walletID := ""
-
-	switch args[1] {
-	case "main":
-		walletID = parsedBusinessInfo.BusinessWalletID
-	case "loan":
-		walletID = parsedBusinessInfo.BusinessLoanWalletID
-	case "liability":
-		walletID = parsedBusinessInfo.BusinessLiabilityWalletID
+	if parsedBusinessInfo.WalletIDs != nil {
+		walletID = parsedBusinessInfo.WalletIDs[args[1]]
+	} else {
+		// businesses written before wallet templates
+		switch args[1] {
+		case "main":
+			walletID = parsedBusinessInfo.BusinessWalletID
+		case "loan":
+			walletID = parsedBusinessInfo.BusinessLoanWalletID
+		case "liability":
+			walletID = parsedBusinessInfo.BusinessLiabilityWalletID
+		}
+	}
+	if walletID == "" {
+		return shim.Error("No " + args[1] + " wallet for business " + args[0])
 	}
 
 	return shim.Success([]byte(walletID))
 }
 
+func reserveLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> businessID
+	 *args[1] -> Amount sanctioned
+	 *
+	 *Called by loancc on sanction. The amount is blocked against the
+	 *business limit till it is disbursed.
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in reserveLimit (required:2) given:" + xLenStr)
+	}
+	err := checkLimitCaller(stub, "reserveLimit")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, err := parseLimitAmt(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	business, err := readBusinessInfo(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	available := availableLimit(business)
+	if amt > available {
+		return shim.Error("Sanction of " + args[1] + " breaches the limit of business " + args[0] + " (limit:" + strconv.FormatInt(business.BusinessLimit, 10) + " utilised:" + strconv.FormatInt(business.LimitUtilised, 10) + " blocked:" + strconv.FormatInt(business.LimitBlocked, 10) + " available:" + strconv.FormatInt(available, 10) + ")")
+	}
+	business.LimitBlocked += amt
+
+	err = writeBusinessInfo(stub, args[0], business)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func drawLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> businessID
+	 *args[1] -> Amount disbursed
+	 *
+	 *Called by loancc on disbursement, moves the amount from blocked to
+	 *utilised and adds it to the business exposure
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in drawLimit (required:2) given:" + xLenStr)
+	}
+	err := checkLimitCaller(stub, "drawLimit")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, err := parseLimitAmt(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	business, err := readBusinessInfo(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if amt > business.LimitBlocked {
+		return shim.Error("Disbursement of " + args[1] + " is more than the sanctioned amount blocked for business " + args[0] + " (blocked:" + strconv.FormatInt(business.LimitBlocked, 10) + ")")
+	}
+	business.LimitBlocked -= amt
+	business.LimitUtilised += amt
+	business.BusinessExposure += amt
+
+	err = writeBusinessInfo(stub, args[0], business)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func releaseLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> businessID
+	 *args[1] -> Utilised amount to release
+	 *args[2] -> Blocked amount to release (optional, the undisbursed part of a closed loan)
+	 *
+	 *Called by loancc on collection
+	 */
+	if len(args) != 2 && len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in releaseLimit (required:2 or 3) given:" + xLenStr)
+	}
+	err := checkLimitCaller(stub, "releaseLimit")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, err := parseLimitAmt(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var blockedAmt int64
+	if len(args) == 3 {
+		blockedAmt, err = parseLimitAmt(args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	business, err := readBusinessInfo(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if amt > business.LimitUtilised {
+		return shim.Error("Release of " + args[1] + " is more than the limit utilised by business " + args[0] + " (utilised:" + strconv.FormatInt(business.LimitUtilised, 10) + ")")
+	}
+	if blockedAmt > business.LimitBlocked {
+		return shim.Error("Release of " + args[2] + " is more than the limit blocked for business " + args[0] + " (blocked:" + strconv.FormatInt(business.LimitBlocked, 10) + ")")
+	}
+	business.LimitUtilised -= amt
+	business.LimitBlocked -= blockedAmt
+	business.BusinessExposure -= amt
+
+	err = writeBusinessInfo(stub, args[0], business)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func getBusinessLimitStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getBusinessLimitStatus (required:1) given:" + xLenStr)
+	}
+	business, err := readBusinessInfo(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	limitStatus := businessLimitStatus{business.BusinessLimit, business.LimitUtilised, business.LimitBlocked, availableLimit(business), business.BusinessExposure}
+	limitStatusBytes, err := json.Marshal(limitStatus)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(limitStatusBytes)
+}
+
+func availableLimit(business businessInfo) int64 {
+	return business.BusinessLimit - business.LimitUtilised - business.LimitBlocked
+}
+
+func parseLimitAmt(amtStr string) (int64, error) {
+	amt, err := strconv.ParseInt(amtStr, 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid amount " + amtStr + ": " + err.Error())
+	}
+	if amt < 0 {
+		return 0, errors.New("Amount cannot be negative: " + amtStr)
+	}
+	return amt, nil
+}
+
+func readBusinessInfo(stub shim.ChaincodeStubInterface, businessID string) (businessInfo, error) {
+	business := businessInfo{}
+	businessBytes, err := stub.GetState(businessID)
+	if err != nil {
+		return business, errors.New("Failed to get the business information: " + err.Error())
+	} else if businessBytes == nil {
+		return business, errors.New("No information is avalilable on this businessID " + businessID)
+	}
+	err = json.Unmarshal(businessBytes, &business)
+	if err != nil {
+		return business, errors.New("Unable to parse businessInfo into the structure " + err.Error())
+	}
+	return business, nil
+}
+
+func writeBusinessInfo(stub shim.ChaincodeStubInterface, businessID string, business businessInfo) error {
+	businessBytes, err := json.Marshal(business)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(businessID, businessBytes)
+}
+
+// checkLimitCaller fails unless the transaction was proposed to loancc, for a
+// sanction, or to txncc, for a disbursement or repayment. The limits only
+// move with the loans of loancc.
+func checkLimitCaller(stub shim.ChaincodeStubInterface, fcnName string) error {
+	ccName, _, err := proposalChaincode(stub)
+	if err != nil {
+		return err
+	}
+	if ccName != "loancc" && ccName != "txncc" {
+		return errors.New(fcnName + " is only called by loancc, the transaction should be proposed to loancc or txncc, given:" + ccName)
+	}
+	return nil
+}
+
+// proposalChaincode returns the chaincode and function the client invoked in
+// the proposal of this transaction, a chaincode called by another one sees
+// the proposal of the first
+func proposalChaincode(stub shim.ChaincodeStubInterface) (string, string, error) {
+	signedProposal, err := stub.GetSignedProposal()
+	if err != nil {
+		return "", "", errors.New("Unable to get the transaction proposal: " + err.Error())
+	}
+	proposal, err := utils.GetProposal(signedProposal.ProposalBytes)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	invocationSpec, err := utils.GetChaincodeInvocationSpec(proposal)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	spec := invocationSpec.GetChaincodeSpec()
+	if spec.GetChaincodeId() == nil || len(spec.GetInput().GetArgs()) == 0 {
+		return "", "", errors.New("No chaincode invocation in the transaction proposal")
+	}
+	return spec.GetChaincodeId().GetName(), string(spec.GetInput().GetArgs()[0]), nil
+}
+
 func main() {
 	err := shim.Start(new(chainCode))
 	if err != nil {
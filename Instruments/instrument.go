@@ -1,19 +1,96 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
 	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
 )
 
 type chainCode struct {
 }
 
+// programParties is the part of getProgram in programcc read by instrumentcc
+type programParties struct {
+	ProgramType   string
+	ProgramAnchor string
+}
+
+// insStatusTransitions lists for each instrument status the statuses it can
+// move to. A repeated status, as with partial disbursements and collections or
+// a further sanction, keeps the status, see setInstrumentStatus.
+var insStatusTransitions = map[string]map[string]bool{
+	"open":              {"sanctioned": true, "overdue": true},
+	"sanctioned":        {"part disbursed": true, "disbursed": true, "overdue": true},
+	"part disbursed":    {"disbursed": true, "part collected": true, "collected/settled": true, "overdue": true},
+	"disbursed":         {"part collected": true, "collected/settled": true, "overdue": true},
+	"part collected":    {"collected/settled": true, "overdue": true},
+	"overdue":           {"part collected": true, "collected/settled": true},
+	"collected/settled": {},
+}
+
+// batchInstrument is one row of uploadInstrumentBatch, the dates are in the
+// same format as the arguments of enterInstrument
+type batchInstrument struct {
+	InstrumentID    string
+	InstrumentRefNo string
+	InstrumentDate  string // dd/mm/yyyy
+	SellBusinessID  string
+	BuyBusinsessID  string
+	InsAmount       int64
+	InsStatus       string // open if empty
+	InsDueDate      string // dd/mm/yyyy
+	ProgramID       string
+	ValueDate       string // dd/mm/yyyy:hh:mm:ss
+}
+
+// batchRowResult reports whether a row of uploadInstrumentBatch was accepted
+// or why it was rejected
+type batchRowResult struct {
+	Row          int
+	InstrumentID string
+	Result       string // accepted or rejected
+	Reason       string
+}
+
+// instrumentPage is one page of the listInstruments queries, Bookmark is
+// given to the next call for the following page and is empty on the last
+type instrumentPage struct {
+	Instruments []instrumentRecord
+	Count       int
+	Bookmark    string
+}
+
+type instrumentRecord struct {
+	InstrumentID string
+	Instrument   instrumentInfo
+}
+
+// defaultPageSize is used when the page size is not given, maxPageSize
+// bounds the state read by one query
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// batchSummary is returned by getBatchSummary
+type batchSummary struct {
+	UploadBatchNo string
+	Count         int
+	TotalAmount   int64
+	StatusCount   map[string]int
+}
+
 type instrumentInfo struct {
 	InstrumentRefNo string
 	InstrumenDate   time.Time
@@ -25,6 +102,21 @@ type instrumentInfo struct {
 	ProgramID       string
 	UploadBatchNo   string
 	ValueDate       time.Time
+	Acceptance      string    // empty until the buyer accepts or rejects
+	AcceptedAt      time.Time // time of acceptance or rejection
+	AcceptedBy      string
+	DisputedAmount  int64
+	RejectReason    string
+	Dilutions       []dilution // credit notes, InsAmount is net of them
+}
+
+// dilution is a credit note applied to an instrument by applyCreditNote
+type dilution struct {
+	Amount    int64
+	Reason    string
+	TxnID     string
+	AppliedBy string
+	AppliedAt time.Time
 }
 
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
@@ -39,6 +131,32 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return getInstrument(stub, args)
 	} else if function == "getSellerID" {
 		return getSellerID(stub, args)
+	} else if function == "getInstrumentByRefNo" {
+		return getInstrumentByRefNo(stub, args)
+	} else if function == "updateInstrumentStatus" {
+		return updateInstrumentStatus(stub, args)
+	} else if function == "updateInstrumentStatusByRefNo" {
+		return updateInstrumentStatusByRefNo(stub, args)
+	} else if function == "getNearDuplicates" {
+		return getNearDuplicates(stub, args)
+	} else if function == "acceptInstrument" {
+		return acceptInstrument(stub, args)
+	} else if function == "rejectInstrument" {
+		return rejectInstrument(stub, args)
+	} else if function == "applyCreditNote" {
+		return applyCreditNote(stub, args)
+	} else if function == "listInstrumentsBySeller" {
+		return listInstrumentsByIndex(stub, "listInstrumentsBySeller", "sellBusID~instID", args)
+	} else if function == "listInstrumentsByBuyer" {
+		return listInstrumentsByIndex(stub, "listInstrumentsByBuyer", "buyBusID~instID", args)
+	} else if function == "listInstrumentsByProgram" {
+		return listInstrumentsByIndex(stub, "listInstrumentsByProgram", "programID~instID", args)
+	} else if function == "listInstrumentsDueBetween" {
+		return listInstrumentsDueBetween(stub, args)
+	} else if function == "uploadInstrumentBatch" {
+		return uploadInstrumentBatch(stub, args)
+	} else if function == "getBatchSummary" {
+		return getBatchSummary(stub, args)
 	}
 
 	return shim.Error("No function named " + function + " in Instrument")
@@ -52,69 +170,439 @@ func enterInstrument(stub shim.ChaincodeStubInterface, args []string) pb.Respons
 
 	}
 
-	//InstrumentDate -> instDate
-	instDate, err := time.Parse("02/01/2006", args[2])
+	inst, err := validateInstrument(stub, args)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	insAmt, err := strconv.ParseInt(args[5], 10, 64)
+	err = putInstrument(stub, args[0], inst)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	return shim.Success(nil)
+}
+
+// validateInstrument checks the 11 enterInstrument arguments against the
+// program, the businesses, their PPR and the instruments already entered,
+// and returns the instrument to write
+func validateInstrument(stub shim.ChaincodeStubInterface, args []string) (instrumentInfo, error) {
+	inst := instrumentInfo{}
+
+	//InstrumentDate -> instDate
+	instDate, err := time.Parse("02/01/2006", args[2])
+	if err != nil {
+		return inst, err
+	}
 
-	insStatusValues := map[string]bool{
-		"open":              true,
-		"sanctioned":        true,
-		"part disbursed":    true,
-		"disbursed":         true,
-		"part collected":    true,
-		"collected/settled": true,
-		"overdue":           true,
+	insAmt, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil {
+		return inst, err
 	}
 
+	// An instrument is always entered open, later statuses are only reached
+	// through updateInstrumentStatus
 	insStatusValuesLower := strings.ToLower(args[6])
-	if !insStatusValues[insStatusValuesLower] {
-		return shim.Error("Invalid Instrument Status " + args[6])
+	if _, ok := insStatusTransitions[insStatusValuesLower]; !ok {
+		return inst, errors.New("Invalid Instrument Status " + args[6])
+	}
+	if insStatusValuesLower != "open" {
+		return inst, errors.New("A new instrument should be open, given:" + args[6])
 	}
 
 	//InsDueDate -> insDate
 	insDueDate, err := time.Parse("02/01/2006", args[7])
 	if err != nil {
-		return shim.Error(err.Error())
+		return inst, err
 	}
 
-	//Checking if the programID exist or not
-	//commented just for testing
-	/*chk, err := stub.GetState(args[8])
-	if chk == nil {
-		return shim.Error("There is no program in this ID (checked from instrument)" + args[8])
-	}*/
+	//Checking if the program is active and the businesses and their PPR exist
+	// programcc reports PROGRAM_NOT_FOUND or why the program cannot take
+	// an instrument of this date
+	err = checkProgramActive(stub, args[8], args[2])
+	if err != nil {
+		return inst, err
+	}
+	programBytes, err := lookupRef(stub, "programcc", "PROGRAM_NOT_FOUND", "program "+args[8], "getProgram", args[8])
+	if err != nil {
+		return inst, err
+	}
+	program := programParties{}
+	err = json.Unmarshal(programBytes, &program)
+	if err != nil {
+		return inst, errors.New("Unable to parse the program " + args[8] + ": " + err.Error())
+	}
+	_, err = lookupRef(stub, "businesscc", "BUSINESS_NOT_FOUND", "seller business "+args[3], "getBusinessInfo", args[3])
+	if err != nil {
+		return inst, err
+	}
+	_, err = lookupRef(stub, "businesscc", "BUSINESS_NOT_FOUND", "buyer business "+args[4], "getBusinessInfo", args[4])
+	if err != nil {
+		return inst, err
+	}
+	if program.ProgramType == "df" {
+		// In dealer finance the anchor sells to its dealers and the dealer
+		// (buyer) is the borrower with the PPR
+		if args[3] != program.ProgramAnchor {
+			return inst, errors.New("Seller " + args[3] + " is not the anchor " + program.ProgramAnchor + " of dealer finance program " + args[8])
+		}
+		_, err = lookupRef(stub, "pprcc", "PPR_NOT_FOUND", "PPR of program "+args[8]+" and dealer "+args[4], "getPPRByBusiness", args[8], args[4])
+		if err != nil {
+			return inst, err
+		}
+	} else {
+		// Only the counterparty of the anchor has a PPR in the program, it can
+		// be either the seller or the buyer
+		_, err = lookupRef(stub, "pprcc", "PPR_NOT_FOUND", "PPR of program "+args[8]+" and business "+args[3], "getPPRByBusiness", args[8], args[3])
+		if err != nil {
+			_, err = lookupRef(stub, "pprcc", "PPR_NOT_FOUND", "PPR of program "+args[8]+" and business "+args[3]+" or "+args[4], "getPPRByBusiness", args[8], args[4])
+			if err != nil {
+				return inst, err
+			}
+		}
+	}
 
 	//Converting the incoming date from Dd/mm/yy:hh:mm:ss to Dd/mm/yyThh:mm:ss for parsing
+	if len(args[10]) != 19 {
+		return inst, errors.New("ValueDate should be dd/mm/yyyy:hh:mm:ss, given:" + args[10])
+	}
 	vString := args[10][:10] + "T" + args[10][11:] //removing the ":" part from the string
 
 	//ValueDate -> vDate
 	vDate, err := time.Parse("02/01/2006T15:04:05", vString)
 	if err != nil {
-		return shim.Error("error in parsing the date and time (instrument)" + err.Error())
+		return inst, errors.New("error in parsing the date and time (instrument)" + err.Error())
+	}
+
+	ifExists, err := stub.GetState(args[0])
+	if err != nil {
+		return inst, err
+	} else if ifExists != nil {
+		return inst, errors.New("InstrumentID " + args[0] + " exists. Cannot create new ID")
+	}
+
+	inst = instrumentInfo{args[1], instDate, args[3], args[4], insAmt, insStatusValuesLower, insDueDate, args[8], args[9], vDate, "", time.Time{}, "", 0, "", nil}
+
+	// The same invoice cannot be entered again under another instrumentID
+	// or program, it would be financed twice
+	fingerprintKey, err := stub.CreateCompositeKey("insFingerprint", []string{instrumentFingerprint(inst)})
+	if err != nil {
+		return inst, errors.New("Unable to create insFingerprint composite key:" + err.Error())
+	}
+	existingID, err := stub.GetState(fingerprintKey)
+	if err != nil {
+		return inst, err
+	} else if existingID != nil {
+		return inst, refError{"DUPLICATE_INSTRUMENT", "invoice " + args[1] + " is already entered as instrument " + string(existingID)}
 	}
 
-	inst := instrumentInfo{args[1], instDate, args[3], args[4], insAmt, insStatusValuesLower, insDueDate, args[8], args[9], vDate}
+	return inst, nil
+}
+
+// putInstrument writes the instrument with its fingerprint, reference number
+// and upload batch indexes
+func putInstrument(stub shim.ChaincodeStubInterface, instID string, inst instrumentInfo) error {
 	instBytes, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(instID, instBytes)
+	if err != nil {
+		return err
+	}
+
+	fingerprintKey, err := stub.CreateCompositeKey("insFingerprint", []string{instrumentFingerprint(inst)})
+	if err != nil {
+		return errors.New("Unable to create insFingerprint composite key:" + err.Error())
+	}
+	err = stub.PutState(fingerprintKey, []byte(instID))
+	if err != nil {
+		return err
+	}
+
+	// Indexes for the listInstruments queries, and the reference number
+	// index for getInstrumentByRefNo and getNearDuplicates. A seller may use
+	// a reference number on more than one instrument, so every instrument
+	// keeps its own entry.
+	queryIndexes := map[string][]string{
+		"instRefNo~sellBusID~instID": {inst.InstrumentRefNo, inst.SellBusinessID, instID},
+		"batchNo~instID":             {inst.UploadBatchNo, instID},
+		"sellBusID~instID":           {inst.SellBusinessID, instID},
+		"buyBusID~instID":            {inst.BuyBusinsessID, instID},
+		"programID~instID":           {inst.ProgramID, instID},
+	}
+	for indexName, attributes := range queryIndexes {
+		indexKey, err := stub.CreateCompositeKey(indexName, attributes)
+		if err != nil {
+			return errors.New("Unable to create " + indexName + " composite key:" + err.Error())
+		}
+		err = stub.PutState(indexKey, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	// Range queries do not take composite keys, so the due date index is a
+	// simple key with the date as yyyymmdd and the instrumentID as value
+	return stub.PutState(dueDateKey(inst.InsDueDate.Format("20060102"), instID), []byte(instID))
+}
+
+// dueDateKey is the key of an instrument in the due date index, a date alone
+// gives the start of that day in the index
+func dueDateKey(dueDate string, instID string) string {
+	return "insDueDate_" + dueDate + "_" + instID
+}
+
+func listInstrumentsByIndex(stub shim.ChaincodeStubInterface, fcnName string, indexName string, args []string) pb.Response {
+
+	/*
+	 *args[0] -> SellBusinessID, BuyBusinsessID or ProgramID
+	 *args[1] -> page size, optional
+	 *args[2] -> bookmark from the previous page, optional
+	 */
+	if len(args) < 1 || len(args) > 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in " + fcnName + " (required:1 to 3) given: " + xLenStr)
+	}
+	pageSize, bookmark, err := pageArgs(args[1:])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	stub.PutState(args[0], instBytes)
+	indexIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(indexName, []string{args[0]}, pageSize, bookmark)
+	if err != nil {
+		return shim.Error("Unable to get the result for composite key : " + indexName)
+	}
+	defer indexIterator.Close()
+	return listInstruments(stub, indexIterator, metadata, pageSize, func(kv *queryresult.KV) (string, error) {
+		_, keyParts, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return "", errors.New("error spliting the composite key " + indexName + ":" + err.Error())
+		}
+		return keyParts[len(keyParts)-1], nil
+	})
+}
+
+func listInstrumentsDueBetween(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	indexName := "instRefNo~sellBusID"
-	refNoBusIDkey, err := stub.CreateCompositeKey(indexName, []string{inst.InstrumentRefNo, inst.SellBusinessID})
+	/*
+	 *args[0] -> from due date, dd/mm/yyyy
+	 *args[1] -> to due date, dd/mm/yyyy, inclusive
+	 *args[2] -> page size, optional
+	 *args[3] -> bookmark from the previous page, optional
+	 */
+	if len(args) < 2 || len(args) > 4 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in listInstrumentsDueBetween (required:2 to 4) given: " + xLenStr)
+	}
+	fromDate, err := time.Parse("02/01/2006", args[0])
 	if err != nil {
-		return shim.Error("Unable to create instRefNo~sellBusID composite key:" + err.Error())
+		return shim.Error(err.Error())
 	}
-	value := []byte{0x00}
-	stub.PutState(refNoBusIDkey, value)
-	return shim.Success(nil)
+	toDate, err := time.Parse("02/01/2006", args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if toDate.Before(fromDate) {
+		return shim.Error("To date " + args[1] + " is before the from date " + args[0])
+	}
+	pageSize, bookmark, err := pageArgs(args[2:])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The index keys of the due dates from fromDate up to the day after toDate
+	startKey := dueDateKey(fromDate.Format("20060102"), "")
+	endKey := dueDateKey(toDate.AddDate(0, 0, 1).Format("20060102"), "")
+	indexIterator, metadata, err := stub.GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+	if err != nil {
+		return shim.Error("Unable to get the instruments due from " + args[0] + " to " + args[1] + ": " + err.Error())
+	}
+	defer indexIterator.Close()
+	return listInstruments(stub, indexIterator, metadata, pageSize, func(kv *queryresult.KV) (string, error) {
+		return string(kv.Value), nil
+	})
+}
+
+// pageArgs parses the optional page size and bookmark arguments of the
+// listInstruments queries
+func pageArgs(args []string) (int32, string, error) {
+	pageSize := int32(defaultPageSize)
+	if len(args) > 0 && args[0] != "" {
+		size, err := strconv.Atoi(args[0])
+		if err != nil || size <= 0 || size > maxPageSize {
+			return 0, "", errors.New("Page size should be from 1 to " + strconv.Itoa(maxPageSize) + ", given:" + args[0])
+		}
+		pageSize = int32(size)
+	}
+	bookmark := ""
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	return pageSize, bookmark, nil
+}
+
+// listInstruments returns the instruments of one page of a paginated index
+// query. instIDOf reads the instrumentID of an index entry.
+func listInstruments(stub shim.ChaincodeStubInterface, indexIterator shim.StateQueryIteratorInterface, metadata *pb.QueryResponseMetadata, pageSize int32, instIDOf func(kv *queryresult.KV) (string, error)) pb.Response {
+	page := instrumentPage{[]instrumentRecord{}, 0, ""}
+	for indexIterator.HasNext() {
+		indexData, err := indexIterator.Next()
+		if err != nil {
+			return shim.Error("Unable to iterate the instrument index:" + err.Error())
+		}
+		instID, err := instIDOf(indexData)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		insBytes, err := stub.GetState(instID)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if insBytes == nil {
+			continue
+		}
+		ins := instrumentInfo{}
+		err = json.Unmarshal(insBytes, &ins)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		page.Instruments = append(page.Instruments, instrumentRecord{instID, ins})
+		page.Count++
+	}
+	// A full page may have more after it, the next call starts at the bookmark
+	if metadata != nil && metadata.FetchedRecordsCount == pageSize {
+		page.Bookmark = metadata.Bookmark
+	}
+
+	pageBytes, err := json.Marshal(page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(pageBytes)
+}
+
+func uploadInstrumentBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> UploadBatchNo
+	 *args[1] -> JSON array of batchInstrument
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in uploadInstrumentBatch (required:2) given: " + xLenStr)
+	}
+	if args[0] == "" {
+		return shim.Error("UploadBatchNo is required in uploadInstrumentBatch")
+	}
+
+	rows := []batchInstrument{}
+	decoder := json.NewDecoder(strings.NewReader(args[1]))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&rows)
+	if err != nil {
+		return shim.Error("Invalid instruments in uploadInstrumentBatch: " + err.Error())
+	}
+	if len(rows) == 0 {
+		return shim.Error("No instruments given in uploadInstrumentBatch")
+	}
+
+	// Writes are not visible to reads in the same transaction, so the
+	// instrumentIDs and fingerprints of the batch are checked here
+	batchIDs := map[string]int{}
+	batchFingerprints := map[string]int{}
+	results := []batchRowResult{}
+	for i, row := range rows {
+		result := batchRowResult{i + 1, row.InstrumentID, "rejected", ""}
+		if row.InstrumentID == "" {
+			result.Reason = "InstrumentID is required"
+			results = append(results, result)
+			continue
+		}
+		if row.InsStatus == "" {
+			row.InsStatus = "open"
+		}
+		insArgs := []string{row.InstrumentID, row.InstrumentRefNo, row.InstrumentDate, row.SellBusinessID, row.BuyBusinsessID, strconv.FormatInt(row.InsAmount, 10), row.InsStatus, row.InsDueDate, row.ProgramID, args[0], row.ValueDate}
+		inst, err := validateInstrument(stub, insArgs)
+		if err != nil {
+			result.Reason = err.Error()
+			results = append(results, result)
+			continue
+		}
+		if dupRow, ok := batchIDs[row.InstrumentID]; ok {
+			result.Reason = "InstrumentID " + row.InstrumentID + " is repeated from row " + strconv.Itoa(dupRow)
+			results = append(results, result)
+			continue
+		}
+		fingerprint := instrumentFingerprint(inst)
+		if dupRow, ok := batchFingerprints[fingerprint]; ok {
+			result.Reason = refError{"DUPLICATE_INSTRUMENT", "invoice " + row.InstrumentRefNo + " is repeated from row " + strconv.Itoa(dupRow)}.Error()
+			results = append(results, result)
+			continue
+		}
+
+		err = putInstrument(stub, row.InstrumentID, inst)
+		if err != nil {
+			return shim.Error("Unable to write instrument " + row.InstrumentID + ": " + err.Error())
+		}
+		batchIDs[row.InstrumentID] = i + 1
+		batchFingerprints[fingerprint] = i + 1
+		result.Result = "accepted"
+		results = append(results, result)
+	}
+
+	resultsBytes, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultsBytes)
+}
+
+func getBatchSummary(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> UploadBatchNo
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getBatchSummary (required:1) given: " + xLenStr)
+	}
+
+	batchIterator, err := stub.GetStateByPartialCompositeKey("batchNo~instID", []string{args[0]})
+	if err != nil {
+		return shim.Error("Unable to get the result for composite key : batchNo~instID")
+	}
+	defer batchIterator.Close()
+
+	summary := batchSummary{args[0], 0, 0, map[string]int{}}
+	for batchIterator.HasNext() {
+		batchData, err := batchIterator.Next()
+		if err != nil {
+			return shim.Error("Unable to iterate batchIterator:" + err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(batchData.Key)
+		if err != nil {
+			return shim.Error("error spliting the composite key batchNo~instID:" + err.Error())
+		}
+		insBytes, err := stub.GetState(keyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if insBytes == nil {
+			continue
+		}
+		ins := instrumentInfo{}
+		err = json.Unmarshal(insBytes, &ins)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		summary.Count++
+		summary.TotalAmount += ins.InsAmount
+		summary.StatusCount[ins.InsStatus]++
+	}
+	if summary.Count == 0 {
+		return shim.Error("No instruments found for upload batch " + args[0])
+	}
+
+	summaryBytes, err := json.Marshal(summary)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(summaryBytes)
 }
 
 func getInstrument(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -133,8 +621,14 @@ func getInstrument(stub shim.ChaincodeStubInterface, args []string) pb.Response
 
 	ins := instrumentInfo{}
 	err = json.Unmarshal(insBytes, &ins)
-	insString := fmt.Sprintf("%+v", ins)
-	return shim.Success([]byte(insString))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	insBytes, err = json.Marshal(ins)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(insBytes)
 }
 
 func getSellerID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -144,24 +638,550 @@ func getSellerID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error("Invalid number of arguments in getSellerID(instrument) (required:1) given: " + xLenStr)
 	}
 
-	instID := args[0]
-	instRefNoSellIDiterator, err := stub.GetStateByPartialCompositeKey("instRefNo~sellBusID", []string{instID})
+	insBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if insBytes == nil {
+		return shim.Error("No data exists on this InstrumentID: " + args[0])
+	}
+	ins := instrumentInfo{}
+	err = json.Unmarshal(insBytes, &ins)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(ins.SellBusinessID))
+}
+
+// refError is returned by the referential integrity checks, Code is one of
+// BUSINESS_NOT_FOUND, PPR_NOT_FOUND or DUPLICATE_INSTRUMENT
+type refError struct {
+	Code string
+	Msg  string
+}
+
+func (e refError) Error() string {
+	return e.Code + ": " + e.Msg
+}
+
+// lookupRef calls a getter of another chaincode to check that a referenced
+// record exists, any failure is reported as a refError of code
+func lookupRef(stub shim.ChaincodeStubInterface, ccName string, code string, what string, args ...string) ([]byte, error) {
+	chaincodeArgs := toChaincodeArgs(args...)
+	response := stub.InvokeChaincode(ccName, chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return nil, refError{code, what + " does not exist (" + response.Message + ")"}
+	}
+	return response.Payload, nil
+}
+
+// checkProgramActive fails if the program does not exist, is not active or
+// date is outside its start and end dates
+func checkProgramActive(stub shim.ChaincodeStubInterface, programID string, date string) error {
+	chaincodeArgs := toChaincodeArgs("checkProgramActive", programID, date)
+	response := stub.InvokeChaincode("programcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+func toChaincodeArgs(args ...string) [][]byte {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	return bargs
+}
+
+func getInstrumentByRefNo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> InstrumentRefNo, as used by the transaction chaincodes
+	 *args[1] -> SellBusinessID, reference numbers are only unique per seller
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getInstrumentByRefNo (required:2) given: " + xLenStr)
+	}
+
+	instID, err := instrumentIDByRefNo(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return getInstrument(stub, []string{instID})
+}
+
+func acceptInstrument(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> InstrumentID
+	 *args[1] -> DisputedAmount, optional and 0 by default
+	 */
+	if len(args) != 1 && len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in acceptInstrument (required:1 or 2) given: " + xLenStr)
+	}
+
+	var disputedAmt int64
+	if len(args) == 2 {
+		amt, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return shim.Error("Invalid disputed amount " + args[1])
+		}
+		disputedAmt = amt
+	}
+
+	ins, err := readInstrumentForBuyer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if disputedAmt < 0 || disputedAmt >= ins.InsAmount {
+		return shim.Error("Disputed amount should be from 0 to less than the instrument amount " + strconv.FormatInt(ins.InsAmount, 10) + ", use rejectInstrument to dispute all of it")
+	}
+	return setInstrumentAcceptance(stub, args[0], ins, "accepted", disputedAmt, "")
+}
+
+func rejectInstrument(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> InstrumentID
+	 *args[1] -> reason
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in rejectInstrument (required:2) given: " + xLenStr)
+	}
+	if strings.TrimSpace(args[1]) == "" {
+		return shim.Error("A reason is required to reject instrument " + args[0])
+	}
+
+	ins, err := readInstrumentForBuyer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return setInstrumentAcceptance(stub, args[0], ins, "rejected", ins.InsAmount, args[1])
+}
+
+// readInstrumentForBuyer reads an instrument the buyer has not accepted or
+// rejected yet, it fails unless the businessID attribute of the caller's
+// certificate is the buyer of the instrument
+func readInstrumentForBuyer(stub shim.ChaincodeStubInterface, instID string) (instrumentInfo, error) {
+	ins := instrumentInfo{}
+	insBytes, err := stub.GetState(instID)
+	if err != nil {
+		return ins, err
+	} else if insBytes == nil {
+		return ins, errors.New("No data exists on this InstrumentID: " + instID)
+	}
+	err = json.Unmarshal(insBytes, &ins)
+	if err != nil {
+		return ins, err
+	}
+
+	callerBusinessID, found, err := cid.GetAttributeValue(stub, "businessID")
+	if err != nil {
+		return ins, errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+	if !found || callerBusinessID != ins.BuyBusinsessID {
+		return ins, errors.New("Only the buyer " + ins.BuyBusinsessID + " of instrument " + instID + " can accept or reject it")
+	}
+	if ins.Acceptance != "" {
+		return ins, errors.New("Instrument " + instID + " is already " + ins.Acceptance + " by the buyer")
+	}
+	if ins.InsStatus != "open" {
+		return ins, errors.New("Instrument " + instID + " is " + ins.InsStatus + ", only an open instrument can be accepted or rejected")
+	}
+	return ins, nil
+}
+
+// setInstrumentAcceptance records the decision of the buyer with who made it
+// and when
+func setInstrumentAcceptance(stub shim.ChaincodeStubInterface, instID string, ins instrumentInfo, acceptance string, disputedAmt int64, reason string) pb.Response {
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	acceptedBy, err := cid.GetID(stub)
+	if err != nil {
+		return shim.Error("Unable to get the identity of the caller: " + err.Error())
+	}
+
+	ins.Acceptance = acceptance
+	ins.AcceptedAt = now
+	ins.AcceptedBy = acceptedBy
+	ins.DisputedAmount = disputedAmt
+	ins.RejectReason = reason
+	insBytes, err := json.Marshal(ins)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(instID, insBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func applyCreditNote(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> InstrumentID
+	 *args[1] -> amount
+	 *args[2] -> reason
+	 *
+	 *The caller needs the businessID attribute of the seller, or role=admin
+	 */
+	if len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in applyCreditNote (required:3) given: " + xLenStr)
+	}
+
+	amt, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return shim.Error("Invalid credit note amount " + args[1])
+	}
+	if strings.TrimSpace(args[2]) == "" {
+		return shim.Error("A reason is required for the credit note on instrument " + args[0])
+	}
+
+	insBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if insBytes == nil {
+		return shim.Error("No data exists on this InstrumentID: " + args[0])
+	}
+	ins := instrumentInfo{}
+	err = json.Unmarshal(insBytes, &ins)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// Only the seller issues credit notes on its invoices, an admin may
+	// record one on its behalf
+	callerBusinessID, sellerFound, err := cid.GetAttributeValue(stub, "businessID")
+	if err != nil {
+		return shim.Error("Unable to get the identity of the caller: " + err.Error())
+	}
+	role, roleFound, err := cid.GetAttributeValue(stub, "role")
 	if err != nil {
-		return shim.Error("Unable to get the result for composite key : instRefNo~sellBusID")
+		return shim.Error("Unable to get the identity of the caller: " + err.Error())
+	}
+	if !(sellerFound && callerBusinessID == ins.SellBusinessID) && !(roleFound && role == "admin") {
+		return shim.Error("Only the seller " + ins.SellBusinessID + " of instrument " + args[0] + " or an admin can apply a credit note")
+	}
+	if ins.InsStatus == "collected/settled" {
+		return shim.Error("Instrument " + args[0] + " is collected/settled, no credit note can be applied")
+	}
+	if amt <= 0 || amt > ins.InsAmount {
+		return shim.Error("Credit note amount should be greater than zero and at most the net instrument amount " + strconv.FormatInt(ins.InsAmount, 10))
 	}
-	var busID string
-	for i := 0; instRefNoSellIDiterator.HasNext(); i++ {
+
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	appliedBy, err := cid.GetID(stub)
+	if err != nil {
+		return shim.Error("Unable to get the identity of the caller: " + err.Error())
+	}
+
+	ins.InsAmount -= amt
+	ins.Dilutions = append(ins.Dilutions, dilution{amt, args[2], stub.GetTxID(), appliedBy, now})
+	insBytes, err = json.Marshal(ins)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(args[0], insBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// loancc flags a shortfall on the loans financed above the new net amount,
+	// it still reads the instrument without this credit note
+	chaincodeArgs := toChaincodeArgs("flagShortfall", args[0], strconv.FormatInt(amt, 10))
+	response := stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return shim.Error("Unable to check the loans of instrument " + args[0] + ": " + response.Message)
+	}
+	return shim.Success(response.Payload)
+}
+
+// instrumentFingerprint identifies an invoice by its seller, buyer,
+// reference number, date and amount, ignoring case and surrounding spaces
+func instrumentFingerprint(inst instrumentInfo) string {
+	fields := []string{
+		strings.ToLower(strings.TrimSpace(inst.SellBusinessID)),
+		strings.ToLower(strings.TrimSpace(inst.BuyBusinsessID)),
+		strings.ToLower(strings.TrimSpace(inst.InstrumentRefNo)),
+		inst.InstrumenDate.Format("02/01/2006"),
+		strconv.FormatInt(inst.InsAmount, 10),
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// nearDuplicate is an instrument with the same reference number as the one
+// queried in getNearDuplicates, Differs lists the fields that do not match
+type nearDuplicate struct {
+	InstrumentID    string
+	InstrumentRefNo string
+	SellBusinessID  string
+	BuyBusinsessID  string
+	InsAmount       int64
+	InstrumenDate   time.Time
+	ProgramID       string
+	Differs         []string
+}
+
+func getNearDuplicates(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> InstrumentID
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getNearDuplicates (required:1) given: " + xLenStr)
+	}
+
+	insBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if insBytes == nil {
+		return shim.Error("No data exists on this InstrumentID: " + args[0])
+	}
+	ins := instrumentInfo{}
+	err = json.Unmarshal(insBytes, &ins)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Instruments sharing the reference number, from any seller
+	instRefNoSellIDiterator, err := stub.GetStateByPartialCompositeKey("instRefNo~sellBusID~instID", []string{ins.InstrumentRefNo})
+	if err != nil {
+		return shim.Error("Unable to get the result for composite key : instRefNo~sellBusID~instID")
+	}
+	defer instRefNoSellIDiterator.Close()
+
+	nearDuplicates := []nearDuplicate{}
+	for instRefNoSellIDiterator.HasNext() {
 		instRefNoSellIData, err := instRefNoSellIDiterator.Next()
 		if err != nil {
 			return shim.Error("Unable to iterate instRefNoSellIDiterator:" + err.Error())
 		}
-		_, requiredArgs, err := stub.SplitCompositeKey(instRefNoSellIData.Key)
+		_, keyParts, err := stub.SplitCompositeKey(instRefNoSellIData.Key)
+		if err != nil {
+			return shim.Error("error spliting the composite key instRefNo~sellBusID~instID:" + err.Error())
+		}
+		otherID := keyParts[2]
+		if otherID == args[0] {
+			continue
+		}
+		otherBytes, err := stub.GetState(otherID)
 		if err != nil {
-			return shim.Error("error spliting the composite key instRefNoSellIDiterator:" + err.Error())
+			return shim.Error(err.Error())
+		} else if otherBytes == nil {
+			continue
+		}
+		other := instrumentInfo{}
+		err = json.Unmarshal(otherBytes, &other)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		differs := []string{}
+		if !strings.EqualFold(other.SellBusinessID, ins.SellBusinessID) {
+			differs = append(differs, "SellBusinessID")
+		}
+		if !strings.EqualFold(other.BuyBusinsessID, ins.BuyBusinsessID) {
+			differs = append(differs, "BuyBusinsessID")
+		}
+		if other.InsAmount != ins.InsAmount {
+			differs = append(differs, "InsAmount")
+		}
+		if !other.InstrumenDate.Equal(ins.InstrumenDate) {
+			differs = append(differs, "InstrumenDate")
 		}
-		busID = requiredArgs[1]
+		if other.ProgramID != ins.ProgramID {
+			differs = append(differs, "ProgramID")
+		}
+		nearDuplicates = append(nearDuplicates, nearDuplicate{otherID, other.InstrumentRefNo, other.SellBusinessID, other.BuyBusinsessID, other.InsAmount, other.InstrumenDate, other.ProgramID, differs})
+	}
+
+	nearDuplicatesBytes, err := json.Marshal(nearDuplicates)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nearDuplicatesBytes)
+}
+
+// instrumentIDByRefNo looks up the instrumentID of a reference number of a
+// seller in the instRefNo~sellBusID~instID index, it fails if the seller
+// used the reference number on more than one instrument
+func instrumentIDByRefNo(stub shim.ChaincodeStubInterface, refNo string, sellerID string) (string, error) {
+	refNoIterator, err := stub.GetStateByPartialCompositeKey("instRefNo~sellBusID~instID", []string{refNo, sellerID})
+	if err != nil {
+		return "", errors.New("Unable to get the result for composite key : instRefNo~sellBusID~instID")
+	}
+	defer refNoIterator.Close()
+
+	instIDs := []string{}
+	for refNoIterator.HasNext() {
+		refNoData, err := refNoIterator.Next()
+		if err != nil {
+			return "", errors.New("Unable to iterate refNoIterator:" + err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(refNoData.Key)
+		if err != nil {
+			return "", errors.New("error spliting the composite key instRefNo~sellBusID~instID:" + err.Error())
+		}
+		instIDs = append(instIDs, keyParts[2])
+	}
+	if len(instIDs) == 0 {
+		return "", errors.New("No instrument found for reference number " + refNo + " of seller " + sellerID)
+	}
+	if len(instIDs) > 1 {
+		return "", errors.New("Reference number " + refNo + " of seller " + sellerID + " is on instruments " + strings.Join(instIDs, ", ") + ", use the InstrumentID")
+	}
+	return instIDs[0], nil
+}
+
+func updateInstrumentStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> InstrumentID
+	 *args[1] -> new InsStatus
+	 *
+	 *Only loancc and the transaction chaincodes move the status, the
+	 *transaction should be proposed to loancc or txncc.
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in updateInstrumentStatus (required:2) given: " + xLenStr)
+	}
+	err := checkStatusCaller(stub, "updateInstrumentStatus")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return setInstrumentStatus(stub, args[0], args[1])
+}
+
+func updateInstrumentStatusByRefNo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> InstrumentRefNo, as used by the transaction chaincodes
+	 *args[1] -> SellBusinessID
+	 *args[2] -> new InsStatus
+	 *
+	 *Only loancc and the transaction chaincodes move the status, the
+	 *transaction should be proposed to loancc or txncc.
+	 */
+	if len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in updateInstrumentStatusByRefNo (required:3) given: " + xLenStr)
+	}
+	err := checkStatusCaller(stub, "updateInstrumentStatusByRefNo")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	instID, err := instrumentIDByRefNo(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return setInstrumentStatus(stub, instID, args[2])
+}
+
+// setInstrumentStatus moves the instrument to status if insStatusTransitions
+// allows it from the current status, an unchanged status is not written
+func setInstrumentStatus(stub shim.ChaincodeStubInterface, instID string, status string) pb.Response {
+	insBytes, err := stub.GetState(instID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if insBytes == nil {
+		return shim.Error("No data exists on this InstrumentID: " + instID)
+	}
+	ins := instrumentInfo{}
+	err = json.Unmarshal(insBytes, &ins)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	statusLower := strings.ToLower(status)
+	if _, ok := insStatusTransitions[statusLower]; !ok {
+		return shim.Error("Invalid Instrument Status " + status)
+	}
+	// A loan sanctioned on an instrument already disbursed in part leaves it
+	// part disbursed, the other loans on it are still being paid out
+	if statusLower == ins.InsStatus || (statusLower == "sanctioned" && ins.InsStatus == "part disbursed") {
+		return shim.Success(nil)
+	}
+	if !insStatusTransitions[ins.InsStatus][statusLower] {
+		return shim.Error("Instrument " + instID + " cannot move from " + ins.InsStatus + " to " + statusLower)
+	}
+	if statusLower == "overdue" {
+		now, err := txnTime(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if now.Before(ins.InsDueDate.AddDate(0, 0, 1)) {
+			return shim.Error("Instrument " + instID + " is not overdue, due on " + ins.InsDueDate.Format("02/01/2006"))
+		}
+	}
+
+	ins.InsStatus = statusLower
+	insBytes, err = json.Marshal(ins)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(instID, insBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// checkStatusCaller fails unless the transaction was proposed to loancc, for a
+// sanction, or to txncc, for a disbursement or repayment. The instrument status
+// only moves with the loans on it.
+func checkStatusCaller(stub shim.ChaincodeStubInterface, fcnName string) error {
+	ccName, _, err := proposalChaincode(stub)
+	if err != nil {
+		return err
+	}
+	if ccName != "loancc" && ccName != "txncc" {
+		return errors.New(fcnName + " is only called by loancc and the transaction chaincodes, the transaction should be proposed to loancc or txncc, given:" + ccName)
+	}
+	return nil
+}
+
+// proposalChaincode returns the chaincode and function the client invoked in
+// the proposal of this transaction, a chaincode called by another one sees
+// the proposal of the first
+func proposalChaincode(stub shim.ChaincodeStubInterface) (string, string, error) {
+	signedProposal, err := stub.GetSignedProposal()
+	if err != nil {
+		return "", "", errors.New("Unable to get the transaction proposal: " + err.Error())
+	}
+	proposal, err := utils.GetProposal(signedProposal.ProposalBytes)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	invocationSpec, err := utils.GetChaincodeInvocationSpec(proposal)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	spec := invocationSpec.GetChaincodeSpec()
+	if spec.GetChaincodeId() == nil || len(spec.GetInput().GetArgs()) == 0 {
+		return "", "", errors.New("No chaincode invocation in the transaction proposal")
+	}
+	return spec.GetChaincodeId().GetName(), string(spec.GetInput().GetArgs()[0]), nil
+}
+
+// txnTime is the timestamp of the transaction proposal
+func txnTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
 	}
-	return shim.Success([]byte(busID))
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
 }
 
 func main() {
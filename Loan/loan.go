@@ -1,16 +1,18 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"reflect"
+	"math"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
 )
 
 type chainCode struct {
@@ -28,6 +30,169 @@ type loanInfo struct {
 	ValueDate          time.Time //with time
 	LoanStatus         string
 	LoanBalance        int64
+	ProgramTerms       programTerms // terms of the program version the loan is sanctioned under
+	Shortfall          int64        // sanctioned above the net instrument amount after credit notes
+	ShortfallRepayment int64        // disbursed above the net instrument amount, to be repayed
+	InterestReceivable int64        // interest accrued by accrueInterest and not yet collected
+	LastAccrualDate    time.Time    // date interest is accrued up to
+	DrawnAmt           int64        // disbursed so far
+	BlockedAmt         int64        // sanctioned and not yet disbursed, blocked against the limits
+	PrincipalRepaid    int64        // part of the repayments that cleared the disbursed amount
+	CollectedAmt       int64        // repayed so far against the instrument
+	BankID             string       // lending bank, its main wallet holds the undisbursed sanction
+}
+
+// loanStatusTransitions is the one table of the loan statuses and the
+// statuses each can move to. A new loan moves from "" to open. A loan can be
+// repayed before it is fully disbursed, and markLoanOverdue moves a loan not
+// collected by its due date to overdue.
+var loanStatusTransitions = map[string]map[string]bool{
+	"":               {"open": true},
+	"open":           {"sanctioned": true},
+	"sanctioned":     {"part disbursed": true, "disbursed": true},
+	"part disbursed": {"part disbursed": true, "disbursed": true, "part collected": true, "collected": true, "overdue": true},
+	"disbursed":      {"part collected": true, "collected": true, "overdue": true},
+	"part collected": {"part collected": true, "collected": true, "overdue": true},
+	"overdue":        {"part collected": true, "collected": true},
+	"collected":      {},
+}
+
+// loanStatusChange is one entry of getLoanStatusHistory
+type loanStatusChange struct {
+	From      string
+	To        string
+	TxnID     string
+	ChangedBy string
+	ChangedAt time.Time
+}
+
+// dayCountBasis is the days in a year of each day-count convention of
+// accrueInterest
+var dayCountBasis = map[string]float64{
+	"ACT/365": 365,
+	"ACT/360": 360,
+	"30/360":  360,
+}
+
+// interestAccrual is returned by accrueInterest
+type interestAccrual struct {
+	AsOfDate      string
+	DayCount      string
+	TotalInterest int64
+	Loans         []loanAccrual
+}
+
+// loanAccrual is the interest accrued on one loan by accrueInterest
+type loanAccrual struct {
+	LoanID    string
+	Principal int64 // outstanding on the accrual date
+	FromDate  time.Time
+	Days      int
+	Interest  int64
+}
+
+// journalRequest is sent to postJournal in walletcc as JSON
+type journalRequest struct {
+	TxnID   string
+	TxnDate string // dd/mm/yyyy
+	LoanID  string
+	InsID   string
+	TxnType string
+	By      string
+	Legs    []journalLeg
+}
+
+// journalLeg is one leg of a postJournal call in walletcc
+type journalLeg struct {
+	WalletID string
+	DAmt     int64
+	CAmt     int64
+}
+
+// programWallet is the part of getProgram in programcc read by accrueInterest
+// for loans sanctioned before the bank was kept on the loan
+type programWallet struct {
+	RepaymentWalletID string
+}
+
+// loanShortfall is one entry of the flagShortfall payload
+type loanShortfall struct {
+	LoanID             string
+	SanctionAmt        int64
+	DisbursedAmt       int64
+	NetInsAmount       int64
+	Shortfall          int64
+	ShortfallRepayment int64
+}
+
+// programTerms is the part of getProgram in programcc kept on the loan at
+// sanction, later amendments of the program do not change it
+type programTerms struct {
+	Version            int
+	ProgramLimit       int64
+	ProgramROI         float64
+	DiscountPercentage float64
+	DiscountPeriod     int
+	ProgramEndDate     time.Time
+}
+
+// loanBalStatus is returned by getLoanBalStatus
+type loanBalStatus struct {
+	LoanBalance     int64
+	LoanStatus      string
+	SanctionAmt     int64
+	InstNum         string
+	DrawnAmt        int64
+	PrincipalRepaid int64
+	CollectedAmt    int64
+	BankID          string
+}
+
+// loanTxnRequest is the JSON request updateLoanInfo accepts from loanbalcc
+// for a disbursement (Mode "disb") or a repayment (Mode "inst")
+type loanTxnRequest struct {
+	TxnID        string
+	TxnDate      string // dd/mm/yyyy
+	Mode         string
+	Amt          int64 // disbursed or repayed
+	PrincipalAmt int64 // inst, part of Amt that clears the disbursed amount
+	LoanStatus   string
+}
+
+// principalChange is a disbursement (Amt above zero) or the principal cleared
+// by a repayment (Amt below zero), interest accrues on each from its date.
+// Stored against the loanID~principalDate~txnID composite key.
+type principalChange struct {
+	TxnID string
+	Date  time.Time
+	Amt   int64
+}
+
+// instrumentStatus is the part of getInstrument in instrumentcc read by loancc
+type instrumentStatus struct {
+	InsStatus      string
+	Acceptance     string
+	InsAmount      int64 // net of credit notes
+	DisputedAmount int64
+}
+
+// programAcceptance is the part of getProgram in programcc read by newLoanInfo
+type programAcceptance struct {
+	BuyerAcceptance bool
+}
+
+// loanBalRequest is sent to putLoanBalInfo in loanbalcc as JSON
+type loanBalRequest struct {
+	LoanBalID  string
+	LoanID     string
+	TxnID      string
+	TxnDate    string // dd/mm/yyyy
+	TxnType    string
+	OpenBal    int64
+	CAmt       int64
+	DAmt       int64
+	LoanBal    int64
+	LoanStatus string
 }
 
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
@@ -41,8 +206,18 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return newLoanInfo(stub, args)
 	} else if function == "getLoanInfo" {
 		return getLoanInfo(stub, args)
+	} else if function == "getLoanBalStatus" {
+		return getLoanBalStatus(stub, args)
 	} else if function == "updateLoanInfo" {
 		return updateLoanInfo(stub, args)
+	} else if function == "flagShortfall" {
+		return flagShortfall(stub, args)
+	} else if function == "getLoanStatusHistory" {
+		return getLoanStatusHistory(stub, args)
+	} else if function == "accrueInterest" {
+		return accrueInterest(stub, args)
+	} else if function == "markLoanOverdue" {
+		return markLoanOverdue(stub, args)
 	}
 	return shim.Error("No function named " + function + " in Loan")
 }
@@ -53,17 +228,58 @@ func newLoanInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error("Invalid number of arguments")
 	}
 
-	//Checking if the instrumentID exist or not
-	/*chk, err := stub.GetState(args[1])
-	if chk == nil {
-		return shim.Error("There is no instrument ID:" + args[1])
-	}*/
+	//Checking if the instrument, the exposure business and their PPR exist,
+	//the instrument is not settled already and the program is active
+	insBytes, err := lookupRef(stub, "instrumentcc", "INSTRUMENT_NOT_FOUND", "instrument "+args[1], "getInstrument", args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ins := instrumentStatus{}
+	err = json.Unmarshal(insBytes, &ins)
+	if err != nil {
+		return shim.Error("Unable to parse the instrument " + args[1] + ": " + err.Error())
+	}
+	if ins.InsStatus == "collected/settled" {
+		return shim.Error(refError{"INSTRUMENT_NOT_ACTIVE", "instrument " + args[1] + " is " + ins.InsStatus}.Error())
+	}
+	_, err = lookupRef(stub, "businesscc", "BUSINESS_NOT_FOUND", "business "+args[2], "getBusinessInfo", args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// The sanction date should be inside the active window of the program
+	err = checkProgramActive(stub, args[3], args[5][:10])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = lookupRef(stub, "pprcc", "PPR_NOT_FOUND", "PPR of program "+args[3]+" and business "+args[2], "getPPRByBusiness", args[3], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// Programs with buyer acceptance finance only the instruments their
+	// buyer has accepted
+	programBytes, err := lookupRef(stub, "programcc", "PROGRAM_NOT_FOUND", "program "+args[3], "getProgram", args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	program := programAcceptance{}
+	err = json.Unmarshal(programBytes, &program)
+	if err != nil {
+		return shim.Error("Unable to parse the program " + args[3] + ": " + err.Error())
+	}
+	if program.BuyerAcceptance && ins.Acceptance != "accepted" {
+		return shim.Error(refError{"INSTRUMENT_NOT_ACCEPTED", "instrument " + args[1] + " is not accepted by its buyer"}.Error())
+	}
 
 	//SanctionAmt -> sAmt
 	sAmt, err := strconv.ParseInt(args[4], 10, 64)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	// The part of the instrument disputed by the buyer cannot be financed
+	financeableAmt := ins.InsAmount - ins.DisputedAmount
+	if sAmt > financeableAmt {
+		return shim.Error(refError{"SANCTION_ABOVE_INSTRUMENT", "sanction of " + args[4] + " is more than the undisputed amount " + strconv.FormatInt(financeableAmt, 10) + " of instrument " + args[1]}.Error())
+	}
 
 	//Converting the incoming date from Dd/mm/yy:hh:mm:ss to Dd/mm/yyThh:mm:ss for parsing
 	sDateStr := args[5][:10]
@@ -126,15 +342,134 @@ func newLoanInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error("LoanId " + args[0] + " exits. Cannot create new ID")
 	}
 
-	loan := loanInfo{args[1], args[2], args[3], sAmt, sDate, args[6], roi, dDate, vDate, "open", loanBalanceString}
+	loan := loanInfo{args[1], args[2], args[3], sAmt, sDate, args[6], roi, dDate, vDate, "", loanBalanceString, programTerms{}, 0, 0, 0, time.Time{}, 0, 0, 0, 0, ""}
+	err = setLoanStatus(stub, args[0], &loan, "open")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	loanBytes, err := json.Marshal(loan)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	stub.PutState(args[0], loanBytes)
+
+	// The loans of an instrument are looked up by flagShortfall
+	instLoanKey, err := stub.CreateCompositeKey("instID~loanID", []string{args[1], args[0]})
+	if err != nil {
+		return shim.Error("Unable to create instID~loanID composite key:" + err.Error())
+	}
+	stub.PutState(instLoanKey, []byte{0x00})
 	return shim.Success(nil)
 }
 
+func flagShortfall(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> InstrumentID
+	 *args[1] -> amount of the credit note being applied
+	 *
+	 *Only applyCreditNote of instrumentcc calls it, within the transaction
+	 *proposed to it. The net amount is worked out from the instrument: the
+	 *instrument read here is still without the credit note, so the net is
+	 *InsAmount, already net of the earlier credit notes, less this credit
+	 *note and the disputed amount.
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in flagShortfall (required:2) given:" + xLenStr)
+	}
+	ccName, function, err := proposalChaincode(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if ccName != "instrumentcc" || function != "applyCreditNote" {
+		return shim.Error("flagShortfall is only called by applyCreditNote, the transaction should be proposed to applyCreditNote of instrumentcc, given:" + function + " of " + ccName)
+	}
+	creditAmt, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || creditAmt <= 0 {
+		return shim.Error("Invalid credit note amount " + args[1])
+	}
+
+	insBytes, err := lookupRef(stub, "instrumentcc", "INSTRUMENT_NOT_FOUND", "instrument "+args[0], "getInstrument", args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	ins := instrumentStatus{}
+	err = json.Unmarshal(insBytes, &ins)
+	if err != nil {
+		return shim.Error("Unable to parse the instrument " + args[0] + ": " + err.Error())
+	}
+	if creditAmt > ins.InsAmount {
+		return shim.Error("Credit note amount " + args[1] + " is more than the net amount " + strconv.FormatInt(ins.InsAmount, 10) + " of instrument " + args[0])
+	}
+	netAmt := ins.InsAmount - creditAmt - ins.DisputedAmount
+	if netAmt < 0 {
+		netAmt = 0
+	}
+
+	instLoanIterator, err := stub.GetStateByPartialCompositeKey("instID~loanID", []string{args[0]})
+	if err != nil {
+		return shim.Error("Unable to get the result for composite key : instID~loanID")
+	}
+	defer instLoanIterator.Close()
+
+	shortfalls := []loanShortfall{}
+	for instLoanIterator.HasNext() {
+		instLoanData, err := instLoanIterator.Next()
+		if err != nil {
+			return shim.Error("Unable to iterate instLoanIterator:" + err.Error())
+		}
+		_, keyParts, err := stub.SplitCompositeKey(instLoanData.Key)
+		if err != nil {
+			return shim.Error("error spliting the composite key instID~loanID:" + err.Error())
+		}
+		loanID := keyParts[1]
+		loanBytes, err := stub.GetState(loanID)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if loanBytes == nil {
+			continue
+		}
+		loan := loanInfo{}
+		err = json.Unmarshal(loanBytes, &loan)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if loan.LoanStatus == "collected" {
+			continue
+		}
+
+		// LoanBalance is the amount yet to be disbursed
+		disbursedAmt := loan.SanctionAmt - loan.LoanBalance
+		loan.Shortfall = 0
+		if loan.SanctionAmt > netAmt {
+			loan.Shortfall = loan.SanctionAmt - netAmt
+		}
+		loan.ShortfallRepayment = 0
+		if disbursedAmt > netAmt {
+			loan.ShortfallRepayment = disbursedAmt - netAmt
+		}
+		loanBytes, err = json.Marshal(loan)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(loanID, loanBytes)
+		if err != nil {
+			return shim.Error("Error in loan updation " + err.Error())
+		}
+		if loan.Shortfall > 0 {
+			fmt.Printf("Loan %s has a shortfall of %d, %d to be repayed\n", loanID, loan.Shortfall, loan.ShortfallRepayment)
+			shortfalls = append(shortfalls, loanShortfall{loanID, loan.SanctionAmt, disbursedAmt, netAmt, loan.Shortfall, loan.ShortfallRepayment})
+		}
+	}
+
+	shortfallsBytes, err := json.Marshal(shortfalls)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(shortfallsBytes)
+}
+
 func getLoanInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
 		xLenStr := strconv.Itoa(len(args))
@@ -154,30 +489,57 @@ func getLoanInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	loanString := fmt.Sprintf("%+v", loan)
-	fmt.Printf("Loan Info:%s\n ", loanString)
-	loanBalString := strconv.FormatInt(loan.LoanBalance, 10)
-	loanStatus := loan.LoanStatus
-	loanSanctionString := strconv.FormatInt(loan.SanctionAmt, 10)
-	var xString bytes.Buffer
+	loanBytes, err = json.Marshal(loan)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(loanBytes)
+}
+
+// getLoanBalStatus is for the chaincodes updating the loan balance, the
+// payload is loanBalStatus as JSON
+func getLoanBalStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getLoanBalStatus (required:1) given:" + xLenStr)
+	}
+
+	loanBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if loanBytes == nil {
+		return shim.Error("No data exists on this loanID: " + args[0])
+	}
+
+	loan := loanInfo{}
+	err = json.Unmarshal(loanBytes, &loan)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	xString.WriteString(loanBalString)
-	xString.WriteString(",")
-	xString.WriteString(loanStatus)
-	xString.WriteString(",")
-	xString.WriteString(loanSanctionString)
-	fmt.Println("args:", xString.String())
-	fmt.Println("Type:", reflect.TypeOf(xString.String()))
-	fmt.Println("Returning the values")
-	//xString = sanctionString + "," + loanStatus
-	return shim.Success([]byte(xString.String()))
+	backfillDrawnAmt(&loan)
+	balStatus := loanBalStatus{loan.LoanBalance, loan.LoanStatus, loan.SanctionAmt, loan.InstNum, loan.DrawnAmt, loan.PrincipalRepaid, loan.CollectedAmt, loan.BankID}
+	balStatusBytes, err := json.Marshal(balStatus)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(balStatusBytes)
 }
 
 func updateLoanInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	/*
-		Updating the variables for loan structure
-	*/
+	 *args[0] -> LoanID
+	 *args[1] -> "sanctioned", or loanTxnRequest as JSON from loanbalcc
+	 *args[2] -> BankID lending the loan, only with "sanctioned"
+	 */
+	if len(args) != 2 && len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in updateLoanInfo (required:2 or 3) given:" + xLenStr)
+	}
+	if (args[1] == "sanctioned") != (len(args) == 3) {
+		return shim.Error("BankID is required to sanction, and only then, in updateLoanInfo")
+	}
 	loanBytes, err := stub.GetState(args[0])
 	if err != nil {
 		return shim.Error(err.Error())
@@ -193,14 +555,61 @@ func updateLoanInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 
 	fmt.Printf("args[1]:%s\n", args[1])
 	// To change the LoanStatus from "open" to "sanction"
-	if len(args) == 2 && args[1] == "sanctioned" {
-
-		loan.LoanStatus = strings.ToLower(args[1])
-		sanctionString := strconv.FormatInt(loan.SanctionAmt, 10)
-		argsToLoanBal := []string{"1loanbal", args[0], "0", "02/01/2006", "0", sanctionString, "0", "0", sanctionString, "sanctioned"}
-		argsString := strings.Join(argsToLoanBal, ",")
-		chaincodeArgs := toChaincodeArgs("putLoanBalInfo", argsString)
-		response := stub.InvokeChaincode("loanbalcc", chaincodeArgs, "myc")
+	if args[1] == "sanctioned" {
+
+		err = setLoanStatus(stub, args[0], &loan, "sanctioned")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		// The sanctioned amount is blocked against the program, PPR and business limits
+		err = updateLimits(stub, "reserveLimit", loan, loan.SanctionAmt)
+		if err != nil {
+			return shim.Error("Unable to sanction loan " + args[0] + ": " + err.Error())
+		}
+		loan.BlockedAmt = loan.SanctionAmt
+		// The sanctioned amount is held in the main wallet of the bank till
+		// it is disbursed, the disbursements capture it
+		loan.BankID = args[2]
+		bankWalletID, err := bankMainWallet(stub, loan.BankID)
+		if err != nil {
+			return shim.Error("Unable to sanction loan " + args[0] + ": " + err.Error())
+		}
+		holdExpiry := loan.DueDate.AddDate(0, 0, 1).Format("02/01/2006")
+		chaincodeArgs := toChaincodeArgs("placeHold", bankWalletID, args[0], strconv.FormatInt(loan.SanctionAmt, 10), holdExpiry)
+		response := stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
+		if response.Status != shim.OK {
+			return shim.Error("Unable to sanction loan " + args[0] + ": " + response.Message)
+		}
+		// The instrument of the loan moves from open to sanctioned
+		chaincodeArgs = toChaincodeArgs("updateInstrumentStatus", loan.InstNum, "sanctioned")
+		response = stub.InvokeChaincode("instrumentcc", chaincodeArgs, "myc")
+		if response.Status != shim.OK {
+			return shim.Error("Unable to sanction loan " + args[0] + ": " + response.Message)
+		}
+
+		// New sanctions pick up the latest version of the program terms
+		chaincodeArgs = toChaincodeArgs("getProgram", loan.ProgramID)
+		response = stub.InvokeChaincode("programcc", chaincodeArgs, "myc")
+		if response.Status != shim.OK {
+			return shim.Error("Unable to get the terms of program " + loan.ProgramID + ": " + response.Message)
+		}
+		err = json.Unmarshal(response.Payload, &loan.ProgramTerms)
+		if err != nil {
+			return shim.Error("Unable to parse the terms of program " + loan.ProgramID + ": " + err.Error())
+		}
+		// The loan runs under these terms till it is collected, so it has
+		// to be due within them
+		if loan.DueDate.After(loan.ProgramTerms.ProgramEndDate) {
+			return shim.Error("Loan " + args[0] + " is due on " + loan.DueDate.Format("02/01/2006") + ", after the end date " + loan.ProgramTerms.ProgramEndDate.Format("02/01/2006") + " of version " + strconv.Itoa(loan.ProgramTerms.Version) + " of program " + loan.ProgramID)
+		}
+
+		loanBalReq := loanBalRequest{"1loanbal", args[0], "0", "02/01/2006", "0", loan.SanctionAmt, 0, 0, loan.SanctionAmt, "sanctioned"}
+		loanBalReqBytes, err := json.Marshal(loanBalReq)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		chaincodeArgs = toChaincodeArgs("putLoanBalInfo", string(loanBalReqBytes))
+		response = stub.InvokeChaincode("loanbalcc", chaincodeArgs, "myc")
 		if response.Status != shim.OK {
 			return shim.Error("Unable to create a loanBal entry from loan:" + response.Message)
 		}
@@ -211,27 +620,617 @@ func updateLoanInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		}
 		return shim.Success([]byte("sanction updated succesfully"))
 
-	} else if len(args) == 3 { // used when called from loanBal
-		//xLenStr := strconv.Itoa(len(args))
-		//return shim.Error("Invalid number of arguments in updateLoanInfo (required:3) given:" + xLenStr)
+	}
 
-		// This "if" condition will be executed when loanBalance chaincode call for updation
+	// Disbursements and repayments from loanBal
+	req := loanTxnRequest{}
+	err = json.Unmarshal([]byte(args[1]), &req)
+	if err != nil {
+		return shim.Error("Invalid request in updateLoanInfo: " + err.Error())
+	}
+	if req.Amt < 0 || req.PrincipalAmt < 0 || req.PrincipalAmt > req.Amt {
+		return shim.Error("Invalid amounts in updateLoanInfo for loan " + args[0])
+	}
+	backfillDrawnAmt(&loan)
+	txnDate, err := time.Parse("02/01/2006", req.TxnDate)
+	if err != nil {
+		return shim.Error("Invalid TxnDate in updateLoanInfo: " + err.Error())
+	}
 
-		loan.LoanStatus = args[1]
-		loan.LoanBalance, err = strconv.ParseInt(args[2], 10, 64)
+	// LoanBalance is the amount yet to be disbursed. What is disbursed moves
+	// from blocked to utilised in the limits, each repayment releases the
+	// principal it clears and the collection releases what is left.
+	status := normalLoanStatus(req.LoanStatus)
+	switch req.Mode {
+	case "disb":
+		if req.Amt > loan.LoanBalance {
+			return shim.Error("Disbursement of " + strconv.FormatInt(req.Amt, 10) + " is more than the undisbursed balance " + strconv.FormatInt(loan.LoanBalance, 10) + " of loan " + args[0])
+		}
+		if req.Amt > 0 {
+			err = updateLimits(stub, "drawLimit", loan, req.Amt)
+			if err != nil {
+				return shim.Error("Unable to draw the limits for loan " + args[0] + ": " + err.Error())
+			}
+		}
+		err = putPrincipalChange(stub, args[0], principalChange{req.TxnID, txnDate, req.Amt})
 		if err != nil {
-			return shim.Error("Unable to parse int in updateLoanInfo:" + err.Error())
+			return shim.Error(err.Error())
+		}
+		loan.LoanBalance -= req.Amt
+		loan.DrawnAmt += req.Amt
+		loan.BlockedAmt -= req.Amt
+		if loan.BlockedAmt < 0 {
+			loan.BlockedAmt = 0
+		}
+	case "inst":
+		if req.PrincipalAmt > loan.DrawnAmt-loan.PrincipalRepaid {
+			return shim.Error("Principal of " + strconv.FormatInt(req.PrincipalAmt, 10) + " is more than the outstanding " + strconv.FormatInt(loan.DrawnAmt-loan.PrincipalRepaid, 10) + " of loan " + args[0])
+		}
+		releaseAmts := []int64{req.PrincipalAmt}
+		if status == "collected" && loan.LoanStatus != "collected" {
+			// what is left drawn and the undisbursed part are released too,
+			// as is the hold on the undisbursed part
+			releaseAmts = []int64{loan.DrawnAmt - loan.PrincipalRepaid, loan.BlockedAmt}
+			if loan.BlockedAmt > 0 && loan.BankID != "" {
+				err = releaseLoanHold(stub, args[0], loan.BankID)
+				if err != nil {
+					return shim.Error("Unable to release the hold of loan " + args[0] + ": " + err.Error())
+				}
+			}
+			loan.BlockedAmt = 0
+		}
+		if releaseAmts[0] > 0 || len(releaseAmts) > 1 {
+			err = updateLimits(stub, "releaseLimit", loan, releaseAmts...)
+			if err != nil {
+				return shim.Error("Unable to release the limits for loan " + args[0] + ": " + err.Error())
+			}
+		}
+		if req.PrincipalAmt > 0 {
+			err = putPrincipalChange(stub, args[0], principalChange{req.TxnID, txnDate, -req.PrincipalAmt})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
 		}
+		loan.PrincipalRepaid += req.PrincipalAmt
+		loan.CollectedAmt += req.Amt
+	default:
+		return shim.Error("Invalid Mode in updateLoanInfo: " + req.Mode)
+	}
 
-		loanBytes, _ = json.Marshal(loan)
-		err = stub.PutState(args[0], loanBytes)
+	err = setLoanStatus(stub, args[0], &loan, status)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	loanBytes, err = json.Marshal(loan)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(args[0], loanBytes)
+	if err != nil {
+		return shim.Error("Error in loan updation " + err.Error())
+	}
+	return shim.Success([]byte("Successfully updated loan with data from loanbal"))
+}
+
+// backfillDrawnAmt sets DrawnAmt and BlockedAmt on loans sanctioned before
+// they were kept, what they have drawn is the sanction less the undisbursed
+// balance and the undisbursed balance is what is blocked
+func backfillDrawnAmt(loan *loanInfo) {
+	switch normalLoanStatus(loan.LoanStatus) {
+	case "sanctioned", "part disbursed", "disbursed":
+		if loan.DrawnAmt == 0 && loan.BlockedAmt == 0 {
+			loan.DrawnAmt = loan.SanctionAmt - loan.LoanBalance
+			loan.BlockedAmt = loan.LoanBalance
+		}
+	}
+}
+
+func markLoanOverdue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> LoanID
+	 *
+	 *Moves a loan not collected by its due date to overdue
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in markLoanOverdue (required:1) given:" + xLenStr)
+	}
+
+	loanBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if loanBytes == nil {
+		return shim.Error("No data exists on this loanID: " + args[0])
+	}
+	loan := loanInfo{}
+	err = json.Unmarshal(loanBytes, &loan)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Before(loan.DueDate.AddDate(0, 0, 1)) {
+		return shim.Error("Loan " + args[0] + " is not overdue, due on " + loan.DueDate.Format("02/01/2006"))
+	}
+	err = setLoanStatus(stub, args[0], &loan, "overdue")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	loanBytes, err = json.Marshal(loan)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(args[0], loanBytes)
+	if err != nil {
+		return shim.Error("Error in loan updation " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+// normalLoanStatus maps a status to its name in loanStatusTransitions, the
+// ledger has "partly disbursed" and "partly collected" from before
+func normalLoanStatus(status string) string {
+	status = strings.ToLower(strings.TrimSpace(status))
+	switch status {
+	case "partly disbursed":
+		return "part disbursed"
+	case "partly collected":
+		return "part collected"
+	}
+	return status
+}
+
+// setLoanStatus moves the loan to status if loanStatusTransitions allows it
+// from the current status and records the transition in the status history
+// of the loan, the caller writes the loan
+func setLoanStatus(stub shim.ChaincodeStubInterface, loanID string, loan *loanInfo, status string) error {
+	from := normalLoanStatus(loan.LoanStatus)
+	to := normalLoanStatus(status)
+	if _, ok := loanStatusTransitions[to]; !ok || to == "" {
+		return errors.New("Invalid loan status " + status)
+	}
+	if !loanStatusTransitions[from][to] {
+		return errors.New("Loan " + loanID + " cannot move from " + from + " to " + to)
+	}
+
+	now, err := txnTime(stub)
+	if err != nil {
+		return err
+	}
+	changedBy, err := cid.GetID(stub)
+	if err != nil {
+		return errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+	change := loanStatusChange{from, to, stub.GetTxID(), changedBy, now}
+	changeBytes, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	// The time leads the key so that the history reads in order
+	historyKey, err := stub.CreateCompositeKey("loanID~statusTime~txnID", []string{loanID, now.Format("20060102150405.000000000"), change.TxnID})
+	if err != nil {
+		return errors.New("Unable to create loanID~statusTime~txnID composite key:" + err.Error())
+	}
+	err = stub.PutState(historyKey, changeBytes)
+	if err != nil {
+		return err
+	}
+
+	loan.LoanStatus = to
+	return nil
+}
+
+func getLoanStatusHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> LoanID
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getLoanStatusHistory (required:1) given:" + xLenStr)
+	}
+
+	historyIterator, err := stub.GetStateByPartialCompositeKey("loanID~statusTime~txnID", []string{args[0]})
+	if err != nil {
+		return shim.Error("Unable to get the result for composite key : loanID~statusTime~txnID")
+	}
+	defer historyIterator.Close()
+
+	history := []loanStatusChange{}
+	for historyIterator.HasNext() {
+		historyData, err := historyIterator.Next()
+		if err != nil {
+			return shim.Error("Unable to iterate historyIterator:" + err.Error())
+		}
+		change := loanStatusChange{}
+		err = json.Unmarshal(historyData.Value, &change)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		history = append(history, change)
+	}
+
+	historyBytes, err := json.Marshal(history)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(historyBytes)
+}
+
+func accrueInterest(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> asOfDate, dd/mm/yyyy
+	 *args[1] -> day-count convention ACT/365, ACT/360 or 30/360, optional and ACT/365 by default
+	 */
+	if len(args) != 1 && len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in accrueInterest (required:1 or 2) given:" + xLenStr)
+	}
+	asOfDate, err := time.Parse("02/01/2006", args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	dayCount := "ACT/365"
+	if len(args) == 2 {
+		dayCount = strings.ToUpper(args[1])
+	}
+	if _, ok := dayCountBasis[dayCount]; !ok {
+		return shim.Error("Invalid day-count convention " + args[1] + ", should be ACT/365, ACT/360 or 30/360")
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if asOfDate.After(now) {
+		return shim.Error("Interest cannot be accrued for a future date " + args[0])
+	}
+	by, err := cid.GetID(stub)
+	if err != nil {
+		return shim.Error("Unable to get the identity of the caller: " + err.Error())
+	}
+
+	// The loans are the simple keys of loancc, the composite keys of the
+	// indexes are not returned by a range query
+	loanIterator, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return shim.Error("Unable to get the loans: " + err.Error())
+	}
+	defer loanIterator.Close()
+
+	accrual := interestAccrual{args[0], dayCount, 0, []loanAccrual{}}
+	for loanIterator.HasNext() {
+		loanData, err := loanIterator.Next()
+		if err != nil {
+			return shim.Error("Unable to iterate loanIterator:" + err.Error())
+		}
+		loan := loanInfo{}
+		err = json.Unmarshal(loanData.Value, &loan)
+		if err != nil || loan.LoanStatus == "" {
+			continue
+		}
+		loanID := loanData.Key
+
+		// Accrual runs up to the last accrual date, so running it again for
+		// the same date accrues nothing
+		fromDate := loan.LastAccrualDate
+		if fromDate.IsZero() {
+			fromDate = time.Date(loan.ValueDate.Year(), loan.ValueDate.Month(), loan.ValueDate.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		if !asOfDate.After(fromDate) {
+			continue
+		}
+
+		if normalLoanStatus(loan.LoanStatus) == "collected" {
+			continue
+		}
+
+		// Each disbursement accrues from its own date and each repayment
+		// stops the accrual on the principal it clears. The rate is the one
+		// of the program terms the loan was sanctioned under.
+		changes, err := readPrincipalChanges(stub, loanID, loan)
+		if err != nil {
+			return shim.Error("Unable to accrue interest on loan " + loanID + ": " + err.Error())
+		}
+		interest, principal := accruedInterest(changes, fromDate, asOfDate, loan.ProgramTerms.ProgramROI, dayCount)
+		days := dayCountDays(dayCount, fromDate, asOfDate)
+		if interest > 0 {
+			err = postAccrual(stub, loanID, loan, asOfDate, interest, by)
+			if err != nil {
+				return shim.Error("Unable to accrue interest on loan " + loanID + ": " + err.Error())
+			}
+			loan.InterestReceivable += interest
+			accrual.TotalInterest += interest
+			accrual.Loans = append(accrual.Loans, loanAccrual{loanID, principal, fromDate, days, interest})
+		}
+
+		// Loans not yet disbursed move their accrual date too, interest
+		// starts from the first accrual after the disbursement
+		loan.LastAccrualDate = asOfDate
+		loanBytes, err := json.Marshal(loan)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(loanID, loanBytes)
 		if err != nil {
 			return shim.Error("Error in loan updation " + err.Error())
 		}
-		return shim.Success([]byte("Successfully updated loan with data from loanbal"))
 	}
-	return shim.Error("Invalid info for update loan")
+
+	accrualBytes, err := json.Marshal(accrual)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(accrualBytes)
+}
+
+// dayCountDays is the days from the from date to the to date under the
+// day-count convention, 30/360 counts every month as 30 days
+func dayCountDays(dayCount string, from time.Time, to time.Time) int {
+	if dayCount != "30/360" {
+		return int(to.Sub(from).Hours() / 24)
+	}
+	d1, d2 := from.Day(), to.Day()
+	if d1 == 31 {
+		d1 = 30
+	}
+	if d2 == 31 && d1 == 30 {
+		d2 = 30
+	}
+	return 360*(to.Year()-from.Year()) + 30*(int(to.Month())-int(from.Month())) + (d2 - d1)
+}
+
+// accruedInterest is the interest from the from date to the to date on the
+// principal outstanding each day, changes are in date order. The principal
+// outstanding at the to date is returned with it.
+func accruedInterest(changes []principalChange, from time.Time, to time.Time, roi float64, dayCount string) (int64, int64) {
+	var principal int64
+	var principalDays float64
+	segmentStart := from
+	for _, change := range changes {
+		if !change.Date.Before(to) {
+			break
+		}
+		if change.Date.After(segmentStart) {
+			principalDays += float64(principal) * float64(dayCountDays(dayCount, segmentStart, change.Date))
+			segmentStart = change.Date
+		}
+		principal += change.Amt
+	}
+	principalDays += float64(principal) * float64(dayCountDays(dayCount, segmentStart, to))
+	return int64(math.Round(principalDays * roi / 100 / dayCountBasis[dayCount])), principal
+}
+
+// putPrincipalChange records a change of the principal of the loan for
+// accrueInterest
+func putPrincipalChange(stub shim.ChaincodeStubInterface, loanID string, change principalChange) error {
+	changeKey, err := stub.CreateCompositeKey("loanID~principalDate~txnID", []string{loanID, change.Date.Format("20060102"), change.TxnID})
+	if err != nil {
+		return errors.New("Unable to create loanID~principalDate~txnID composite key:" + err.Error())
+	}
+	changeBytes, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(changeKey, changeBytes)
+}
+
+// readPrincipalChanges returns the principal changes of the loan in date
+// order. What was disbursed or repayed before they were recorded is taken as
+// one change on the value date of the loan.
+func readPrincipalChanges(stub shim.ChaincodeStubInterface, loanID string, loan loanInfo) ([]principalChange, error) {
+	changeIterator, err := stub.GetStateByPartialCompositeKey("loanID~principalDate~txnID", []string{loanID})
+	if err != nil {
+		return nil, errors.New("Unable to get the result for composite key : loanID~principalDate~txnID")
+	}
+	defer changeIterator.Close()
+
+	changes := []principalChange{}
+	var recorded int64
+	for changeIterator.HasNext() {
+		changeData, err := changeIterator.Next()
+		if err != nil {
+			return nil, errors.New("Unable to iterate changeIterator:" + err.Error())
+		}
+		change := principalChange{}
+		err = json.Unmarshal(changeData.Value, &change)
+		if err != nil {
+			return nil, err
+		}
+		recorded += change.Amt
+		changes = append(changes, change)
+	}
+
+	backfillDrawnAmt(&loan)
+	unrecorded := loan.DrawnAmt - loan.PrincipalRepaid - recorded
+	if unrecorded != 0 {
+		valueDate := time.Date(loan.ValueDate.Year(), loan.ValueDate.Month(), loan.ValueDate.Day(), 0, 0, 0, 0, time.UTC)
+		changes = append([]principalChange{{"", valueDate, unrecorded}}, changes...)
+	}
+	return changes, nil
+}
+
+// postAccrual posts the interest accrued on a loan as a journal in walletcc,
+// the borrower's loan wallet is debited as the interest adds to its debt and
+// the asset wallet of the bank credited as the interest receivable grows. No
+// money moves, loans without a bank credit the repayment wallet of the
+// program.
+func postAccrual(stub shim.ChaincodeStubInterface, loanID string, loan loanInfo, asOfDate time.Time, interest int64, by string) error {
+	chaincodeArgs := toChaincodeArgs("getWalletID", loan.ExposureBusinessID, "loan")
+	response := stub.InvokeChaincode("businesscc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return errors.New("loan wallet of business " + loan.ExposureBusinessID + ": " + response.Message)
+	}
+	loanWalletID := string(response.Payload)
+
+	receivableWalletID := ""
+	if loan.BankID != "" {
+		chaincodeArgs = toChaincodeArgs("getWalletID", loan.BankID, "asset")
+		response = stub.InvokeChaincode("bankcc", chaincodeArgs, "myc")
+		if response.Status != shim.OK {
+			return errors.New("asset wallet of bank " + loan.BankID + ": " + response.Message)
+		}
+		receivableWalletID = string(response.Payload)
+	} else {
+		chaincodeArgs = toChaincodeArgs("getProgram", loan.ProgramID)
+		response = stub.InvokeChaincode("programcc", chaincodeArgs, "myc")
+		if response.Status != shim.OK {
+			return errors.New("program " + loan.ProgramID + ": " + response.Message)
+		}
+		program := programWallet{}
+		err := json.Unmarshal(response.Payload, &program)
+		if err != nil {
+			return errors.New("Unable to parse the program " + loan.ProgramID + ": " + err.Error())
+		}
+		if program.RepaymentWalletID == "" {
+			return errors.New("program " + loan.ProgramID + " has no repayment wallet")
+		}
+		receivableWalletID = program.RepaymentWalletID
+	}
+
+	// The txnID is the same for a loan and date, txnbalcc refuses a second
+	// posting of it
+	txnID := "accrual_" + loanID + "_" + asOfDate.Format("20060102")
+	journal := journalRequest{txnID, asOfDate.Format("02/01/2006"), loanID, loan.InstNum, "interest accrual", by, []journalLeg{{loanWalletID, interest, 0}, {receivableWalletID, 0, interest}}}
+	journalBytes, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	chaincodeArgs = toChaincodeArgs("postJournal", string(journalBytes))
+	response = stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// txnTime is the timestamp of the transaction proposal
+func txnTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// updateLimits calls limitFcn (reserveLimit, drawLimit or releaseLimit) on
+// every level of the limit tree of the loan: the program, the PPR of the
+// program and the exposure business, and the business. All the levels are
+// updated in the same transaction, so if any level fails nothing is written
+// and the failed level is reported.
+func updateLimits(stub shim.ChaincodeStubInterface, limitFcn string, loan loanInfo, amts ...int64) error {
+	limitLevels := []struct {
+		level  string
+		ccName string
+		ids    []string
+	}{
+		{"program", "programcc", []string{loan.ProgramID}},
+		{"program-business (PPR)", "pprcc", []string{loan.ProgramID, loan.ExposureBusinessID}},
+		{"business", "businesscc", []string{loan.ExposureBusinessID}},
+	}
+
+	for _, limitLevel := range limitLevels {
+		limitArgs := append([]string{limitFcn}, limitLevel.ids...)
+		for _, amt := range amts {
+			limitArgs = append(limitArgs, strconv.FormatInt(amt, 10))
+		}
+		chaincodeArgs := toChaincodeArgs(limitArgs...)
+		response := stub.InvokeChaincode(limitLevel.ccName, chaincodeArgs, "myc")
+		if response.Status != shim.OK {
+			return errors.New("limit check failed at " + limitLevel.level + " level: " + response.Message)
+		}
+	}
+	return nil
+}
+
+// bankMainWallet is the main wallet of the bank
+func bankMainWallet(stub shim.ChaincodeStubInterface, bankID string) (string, error) {
+	chaincodeArgs := toChaincodeArgs("getWalletID", bankID, "main")
+	response := stub.InvokeChaincode("bankcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return "", errors.New("main wallet of bank " + bankID + ": " + response.Message)
+	}
+	return string(response.Payload), nil
 }
+
+// releaseLoanHold releases what is left of the hold placed on the main wallet
+// of the bank at sanction
+func releaseLoanHold(stub shim.ChaincodeStubInterface, loanID string, bankID string) error {
+	bankWalletID, err := bankMainWallet(stub, bankID)
+	if err != nil {
+		return err
+	}
+	chaincodeArgs := toChaincodeArgs("releaseHold", bankWalletID, loanID)
+	response := stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// refError is returned by the referential integrity checks, Code is one of
+// INSTRUMENT_NOT_FOUND, INSTRUMENT_NOT_ACTIVE, INSTRUMENT_NOT_ACCEPTED,
+// BUSINESS_NOT_FOUND or PPR_NOT_FOUND
+type refError struct {
+	Code string
+	Msg  string
+}
+
+func (e refError) Error() string {
+	return e.Code + ": " + e.Msg
+}
+
+// lookupRef calls a getter of another chaincode to check that a referenced
+// record exists, any failure is reported as a refError of code
+func lookupRef(stub shim.ChaincodeStubInterface, ccName string, code string, what string, args ...string) ([]byte, error) {
+	chaincodeArgs := toChaincodeArgs(args...)
+	response := stub.InvokeChaincode(ccName, chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return nil, refError{code, what + " does not exist (" + response.Message + ")"}
+	}
+	return response.Payload, nil
+}
+
+// checkProgramActive fails if the program does not exist, is not active or
+// date is outside its start and end dates
+func checkProgramActive(stub shim.ChaincodeStubInterface, programID string, date string) error {
+	chaincodeArgs := toChaincodeArgs("checkProgramActive", programID, date)
+	response := stub.InvokeChaincode("programcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// proposalChaincode returns the chaincode and function the client invoked in
+// the proposal of this transaction, a chaincode called by another one sees
+// the proposal of the first
+func proposalChaincode(stub shim.ChaincodeStubInterface) (string, string, error) {
+	signedProposal, err := stub.GetSignedProposal()
+	if err != nil {
+		return "", "", errors.New("Unable to get the transaction proposal: " + err.Error())
+	}
+	proposal, err := utils.GetProposal(signedProposal.ProposalBytes)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	invocationSpec, err := utils.GetChaincodeInvocationSpec(proposal)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	spec := invocationSpec.GetChaincodeSpec()
+	if spec.GetChaincodeId() == nil || len(spec.GetInput().GetArgs()) == 0 {
+		return "", "", errors.New("No chaincode invocation in the transaction proposal")
+	}
+	return spec.GetChaincodeId().GetName(), string(spec.GetInput().GetArgs()[0]), nil
+}
+
 func toChaincodeArgs(args ...string) [][]byte {
 	bargs := make([][]byte, len(args))
 	for i, arg := range args {
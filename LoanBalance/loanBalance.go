@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -15,9 +16,28 @@ type chainCode struct {
 }
 
 type loanBalanceInfo struct {
+	LoanID         string
+	TxnID          string
+	TxnDate        time.Time
+	TxnType        string
+	OpenBal        int64
+	CAmt           int64
+	DAmt           int64
+	LoanBal        int64
+	LoanStatus     string
+	PaidBy         string // business that repaid, for repayments
+	SettlementMode string // direct, or anchor for an AP settlement
+	RepaidAmt      int64  // repayments, amount repayed
+	PrincipalAmt   int64  // repayments, part of RepaidAmt that cleared the disbursed amount
+	CollectedAmt   int64  // repayed so far against the instrument
+}
+
+// loanBalRequest is the JSON request putLoanBalInfo accepts from loancc
+type loanBalRequest struct {
+	LoanBalID  string
 	LoanID     string
 	TxnID      string
-	TxnDate    time.Time
+	TxnDate    string // dd/mm/yyyy
 	TxnType    string
 	OpenBal    int64
 	CAmt       int64
@@ -26,6 +46,48 @@ type loanBalanceInfo struct {
 	LoanStatus string
 }
 
+// updateLoanBalRequest is the JSON request updateLoanBal accepts from
+// disbursementcc (Mode "disb") and repaycc (Mode "inst")
+type updateLoanBalRequest struct {
+	LoanBalID      string
+	LoanID         string
+	TxnID          string
+	TxnDate        string // dd/mm/yyyy
+	TxnType        string
+	CAmt           int64 // disb
+	DAmt           int64 // disb
+	Amt            int64 // inst, repayed amount
+	InsID          string
+	Mode           string // disb or inst
+	PaidBy         string // inst, business that repaid
+	SettlementMode string // inst, direct or anchor
+}
+
+// updateLoanBalResult is returned by updateLoanBal as JSON, a repayment is
+// split into the principal clearing the disbursed amount and the refund of
+// the rest to the borrower
+type updateLoanBalResult struct {
+	LoanStatus   string
+	PrincipalAmt int64
+	RefundAmt    int64
+	CollectedAmt int64
+}
+
+// loanTxnRequest is sent to updateLoanInfo in loancc as JSON
+type loanTxnRequest struct {
+	TxnID        string
+	TxnDate      string // dd/mm/yyyy
+	Mode         string
+	Amt          int64
+	PrincipalAmt int64
+	LoanStatus   string
+}
+
+// instrumentAmount is the part of getInstrument in instrumentcc read by updateLoanBal
+type instrumentAmount struct {
+	InsAmount int64 // net of credit notes
+}
+
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
@@ -43,16 +105,28 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 }
 
 func putLoanBalInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) == 1 {
-		args = strings.Split(args[0], ",")
-	}
-	if len(args) != 10 {
+	/*
+	 *args[0] -> loanBalRequest as JSON
+	 */
+	if len(args) != 1 {
 		xLenStr := strconv.Itoa(len(args))
-		return shim.Error("Invalid number of arguments in putLoanBalInfo (required:10) given:" + xLenStr)
+		return shim.Error("Invalid number of arguments in putLoanBalInfo (required:1) given:" + xLenStr)
+	}
+
+	req := loanBalRequest{}
+	err := decodeRequest(args[0], &req)
+	if err != nil {
+		return shim.Error("Invalid request in putLoanBalInfo: " + err.Error())
+	}
+	if req.LoanBalID == "" || req.LoanID == "" {
+		return shim.Error("LoanBalID and LoanID are required in putLoanBalInfo")
+	}
+	if req.OpenBal < 0 || req.CAmt < 0 || req.DAmt < 0 || req.LoanBal < 0 {
+		return shim.Error("Amounts cannot be negative in putLoanBalInfo")
 	}
 
 	//TxnDate -> transDate
-	transDate, err := time.Parse("02/01/2006", args[3])
+	transDate, err := time.Parse("02/01/2006", req.TxnDate)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -65,31 +139,11 @@ func putLoanBalInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		"other changes": true,
 	}
 
-	txnTypeLower := strings.ToLower(args[4])
+	txnTypeLower := strings.ToLower(req.TxnType)
 	if !txnTypeValues[txnTypeLower] {
 		return shim.Error("Invalid Transaction type " + txnTypeLower)
 	}*/
 
-	openBal, err := strconv.ParseInt(args[5], 10, 64)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	cAmt, err := strconv.ParseInt(args[6], 10, 64)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	dAmt, err := strconv.ParseInt(args[7], 10, 64)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	loanBal, err := strconv.ParseInt(args[8], 10, 64)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-
 	loanStatusValues := map[string]bool{
 		"open":           true,
 		"sanctioned":     true,
@@ -99,17 +153,20 @@ func putLoanBalInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		"collected":      true,
 		"overdue":        true,
 	}
-	loanStatusLower := strings.ToLower(args[9])
+	loanStatusLower := strings.ToLower(req.LoanStatus)
 	if !loanStatusValues[loanStatusLower] {
 		return shim.Error("Invalid Loan Status type " + loanStatusLower)
 	}
 
-	loanBalance := loanBalanceInfo{args[1], args[2], transDate, args[4], openBal, cAmt, dAmt, loanBal, loanStatusLower}
+	loanBalance := loanBalanceInfo{req.LoanID, req.TxnID, transDate, req.TxnType, req.OpenBal, req.CAmt, req.DAmt, req.LoanBal, loanStatusLower, "", "", 0, 0, 0}
 	loanBalanceBytes, err := json.Marshal(loanBalance)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	err = stub.PutState(args[0], loanBalanceBytes)
+	err = stub.PutState(req.LoanBalID, loanBalanceBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 
@@ -133,232 +190,215 @@ func getLoanBalInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	if err != nil {
 		return shim.Error("Unable to parse into the structure " + err.Error())
 	}
-	jsonString := fmt.Sprintf("%+v", loanBalance)
-	return shim.Success([]byte(jsonString))
+	loanBalanceBytes, err = json.Marshal(loanBalance)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(loanBalanceBytes)
 }
 
 func updateLoanBal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	/*
-			// From Disbursement
-		/*
-		*LoanBalId -> args[0]
-		*LoanID  -> args[1]
-		*TxnID   -> args[2]
-		*TxnDate -> args[3]
-		*TxnType -> args[4]
-		*DAmt    -> args[5]
-
-
-		*OpenBal -> LoanBalance from Loan structure
-		*CAmt
-
-		*LoanBal -> OpenBal-DAmt+Camt
-		*LoanStatus -> depends
-	*/
+	*args[0] -> updateLoanBalRequest as JSON
+	*
+	*OpenBal -> LoanBalance from Loan structure
+	*LoanBal -> OpenBal-DAmt+Camt
+	*LoanStatus -> depends
+	*
+	*Returns updateLoanBalResult as JSON
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in updateLoanBal (required:1) given:" + xLenStr)
+	}
 
-	if len(args) == 1 {
-		args = strings.Split(args[0], ",")
+	req := updateLoanBalRequest{}
+	err := decodeRequest(args[0], &req)
+	if err != nil {
+		return shim.Error("Invalid request in updateLoanBal: " + err.Error())
+	}
+	if req.LoanBalID == "" || req.LoanID == "" || req.TxnID == "" {
+		return shim.Error("LoanBalID, LoanID and TxnID are required in updateLoanBal")
+	}
+	if req.Mode != "disb" && req.Mode != "inst" {
+		return shim.Error("Invalid Mode in updateLoanBal: " + req.Mode)
+	}
+	if req.CAmt < 0 || req.DAmt < 0 || req.Amt < 0 {
+		return shim.Error("Amounts cannot be negative in updateLoanBal")
 	}
 
 	loanBalance := loanBalanceInfo{}
-	loanBalanceBytes, err := stub.GetState(args[0])
+	loanBalanceBytes, err := stub.GetState(req.LoanBalID)
 	if err != nil {
 		return shim.Error("Failed to get the loan balance information: " + err.Error())
 	} else if loanBalanceBytes == nil {
-		return shim.Error("No information is avalilable on this loan balance " + args[0])
+		return shim.Error("No information is avalilable on this loan balance " + req.LoanBalID)
 	}
 
 	err = json.Unmarshal(loanBalanceBytes, &loanBalance)
 	if err != nil {
 		return shim.Error("Unable to parse loan balance into the structure " + err.Error())
 	}
-	chaincodeArgs := toChaincodeArgs("getLoanInfo", args[1])
-	fmt.Println("calling the other chaincode")
-	response := stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+	loan, err := getLoanBalStatus(stub, req.LoanID)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	//spliting the arguments got from loan as response (loanBalance -> [0] and status -> [1] and SanctionAmt -> args[2])
-	loanArgs := strings.Split(string(response.Payload), ",")
-	timeType, err := time.Parse("02/01/2006", args[3])
+	timeType, err := time.Parse("02/01/2006", req.TxnDate)
 	if err != nil {
 		return shim.Error("timeType cant be converted," + err.Error())
 	}
 
+	loanBalance.LoanID = req.LoanID
+	loanBalance.TxnID = req.TxnID
 	loanBalance.TxnDate = timeType
-
-	if args[7] == "disb" {
-		if len(args) != 8 {
-			xLenStr := strconv.Itoa(len(args))
-			return shim.Error("Invalid number of arguments in updateLoanBal:disb (required:8) given:" + xLenStr)
-
-		}
-
-		timeType, err := time.Parse("02/01/2006", args[3])
-		if err != nil {
-			return shim.Error("timeType cant be converted," + err.Error())
-		}
-
-		//loanArgs := string(response.Payload)
-		/*fmt.Printf("disbursement payload:%s\n", loanArgs)
-		fmt.Println("loanArgs[0]", loanArgs[0])
-		fmt.Println("[0] type:", reflect.TypeOf(loanArgs[0]))
-		fmt.Println("loanArgs[1]", loanArgs[1])
-		fmt.Println("[1] type:", reflect.TypeOf(loanArgs[1]))*/
-
-		openBal, err := strconv.ParseInt(loanArgs[0], 10, 64)
-		if err != nil {
-			return shim.Error("Error in parsing the openbalance in LoanBalance: " + err.Error())
-		}
-		fmt.Println("Strconv is done")
-		CAmt, err := strconv.ParseInt(args[5], 10, 64)
-		if err != nil {
-			return shim.Error("Error in parsing the CAmt in LoanBalance: " + err.Error())
+	loanBalance.TxnType = req.TxnType
+	loanBalance.OpenBal = loan.LoanBalance
+	loanBalance.CollectedAmt = loan.CollectedAmt
+
+	result := updateLoanBalResult{CollectedAmt: loan.CollectedAmt}
+	loanReq := loanTxnRequest{TxnID: req.TxnID, TxnDate: req.TxnDate, Mode: req.Mode}
+	if req.Mode == "disb" {
+		// LoanBalance is the amount yet to be disbursed
+		loanBal := loan.LoanBalance - req.DAmt + req.CAmt
+		if loanBal < 0 {
+			return shim.Error("Disbursement of " + strconv.FormatInt(req.DAmt, 10) + " is more than the undisbursed balance " + strconv.FormatInt(loan.LoanBalance, 10) + " of loan " + req.LoanID)
 		}
-		DAmt, err := strconv.ParseInt(args[6], 10, 64)
-		if err != nil {
-			return shim.Error("Error in parsing the DAmt in LoanBalance: " + err.Error())
-		}
-
-		var status string
-		status = loanArgs[1] // status of the current loan
-		fmt.Println("status after received :", status)
-		loanBal := openBal - DAmt + CAmt
-		/*fmt.Println("openBal:", openBal)
-		fmt.Println("DAmt:", DAmt)
-		fmt.Println("CAmt:", CAmt)
-		fmt.Println("loanBal:", loanBal)
-		fmt.Println("above loanBalstring")*/
-		loanBalString := strconv.FormatInt(loanBal, 10)
-		if status == "sanctioned" || status == "partly disbursed" {
 
+		status := loan.LoanStatus // status of the current loan
+		// loancc has "partly disbursed" from before, it reads as "part disbursed"
+		if status == "sanctioned" || status == "part disbursed" || status == "partly disbursed" {
 			if loanBal == 0 {
 				status = "disbursed"
 			} else {
-				status = "partly disbursed"
+				status = "part disbursed"
 			}
 		}
-		//fmt.Println("after the if statement")
 
-		//Updating loanBalance ledger
-
-		/*LoanID  -> args[1]
-		*TxnID   -> args[2]
-		*TxnDate -> args[3]
-		*TxnType -> args[4]
-		*DAmt    -> args[5]
-		 */
-
-		loanBalance.LoanID = args[1]
-		loanBalance.TxnID = args[2]
-		loanBalance.TxnDate = timeType
-		loanBalance.TxnType = args[4]
 		loanBalance.LoanStatus = status
-		loanBalance.CAmt = CAmt
-		loanBalance.DAmt = DAmt
+		loanBalance.PaidBy = ""
+		loanBalance.SettlementMode = ""
+		loanBalance.CAmt = req.CAmt
+		loanBalance.DAmt = req.DAmt
 		loanBalance.LoanBal = loanBal
-		loanBalance.OpenBal = openBal
-
-		loanBalanceBytes, _ = json.Marshal(loanBalance)
-		stub.PutState(args[0], loanBalanceBytes)
-		fmt.Println("written into loan balance ledger")
-
-		fmt.Printf("Status:%s\n", status)
-		chaincodeArgs = toChaincodeArgs("updateLoanInfo", args[1], status, loanBalString)
-		fmt.Println("calling the other chaincode in if condition")
-		response = stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
-		if response.Status != shim.OK {
-			return shim.Error(response.Message)
-		}
-	}
-	if args[7] == "inst" {
-		if len(args) != 8 {
-			xLenStr := strconv.Itoa(len(args))
-			return shim.Error("Invalid number of arguments in updateLoanBal:inst (required:8) given:" + xLenStr)
-		}
-		/*
-				// From Repayment
-			*LoanBalId -> args[0]
-			*LoanID  -> args[1]
-			*TxnID   -> args[2]
-			*TxnDate -> args[3]
-			*TxnType -> args[4]
-			*Amt    -> args[5] // Repayed Amt
-			*insId  -> args[4]
-
-
-			*OpenBal -> LoanBalance from Loan structure
-			*CAmt
-
-			*LoanBal -> OpenBal-DAmt+Camt
-			*LoanStatus -> depends
-		*/
-
-		invoiceAmt := int64(1000) //Have to get from instrument
-		sanctionedAmt, err := strconv.ParseInt(loanArgs[2], 10, 64)
+		loanBalance.RepaidAmt = 0
+		loanBalance.PrincipalAmt = 0
+
+		loanReq.Amt = req.DAmt - req.CAmt
+		loanReq.LoanStatus = status
+		result.LoanStatus = status
+	} else {
+		// From Repayment, req.Amt is the repayed amount. It first clears what
+		// is disbursed and not yet repayed, the rest is refunded to the
+		// borrower. The loan is collected once the repayments add up to the
+		// instrument amount.
+		insBytes, err := lookupInstrument(stub, loan.InstNum)
 		if err != nil {
-			return shim.Error("Error in parsing the sanctionedAmt in LoanBalance: " + err.Error())
+			return shim.Error(err.Error())
 		}
-		disbursedAmt := sanctionedAmt - loanBalance.LoanBal
-		repayedAmt, err := strconv.ParseInt(args[5], 10, 64)
+		ins := instrumentAmount{}
+		err = json.Unmarshal(insBytes, &ins)
 		if err != nil {
-			return shim.Error("Error in parsing the repayedAmt in LoanBalance: " + err.Error())
+			return shim.Error("Unable to parse the instrument " + loan.InstNum + ": " + err.Error())
 		}
 
-		var bankAssetVal int64
-		var bankRefundVal int64
-		var businessLoanVal int64
-		if repayedAmt > disbursedAmt && repayedAmt == invoiceAmt {
-			loanBalance.LoanStatus = "collected"
-			bankAssetVal = disbursedAmt
-			bankRefundVal = repayedAmt - loanBalance.OpenBal
-			businessLoanVal = loanBalance.OpenBal
-		} else if repayedAmt > disbursedAmt && repayedAmt < invoiceAmt {
-			loanBalance.LoanStatus = "partly collected"
-			bankAssetVal = loanBalance.OpenBal
-			bankRefundVal = repayedAmt - loanBalance.OpenBal
-			businessLoanVal = loanBalance.OpenBal
-		} else if repayedAmt == loanBalance.LoanBal {
-			loanBalance.LoanStatus = "partly collected"
-			bankAssetVal = repayedAmt
-			bankRefundVal = 0
-			businessLoanVal = repayedAmt
-		} else if repayedAmt < disbursedAmt {
-			loanBalance.LoanStatus = "partly collected"
-			bankAssetVal = repayedAmt
-			businessLoanVal = repayedAmt
+		outstanding := loan.DrawnAmt - loan.PrincipalRepaid
+		principalAmt := req.Amt
+		if principalAmt > outstanding {
+			principalAmt = outstanding
 		}
-		bankAssetValString := strconv.FormatInt(bankAssetVal, 10)
-		bankRefundValString := strconv.FormatInt(bankRefundVal, 10)
-		businessLoanValString := strconv.FormatInt(businessLoanVal, 10)
+		collectedAmt := loan.CollectedAmt + req.Amt
 
-		returnVal := bankAssetValString + "," + bankRefundValString + "," + businessLoanValString
+		status := "part collected"
+		if collectedAmt >= ins.InsAmount {
+			status = "collected"
+		}
 
-		loanBalance.LoanID = args[1]
-		loanBalance.TxnID = args[2]
-		loanBalance.TxnDate = timeType
-		loanBalance.TxnType = args[4]
+		// A repayment leaves the undisbursed balance as it is
+		loanBalance.LoanStatus = status
+		loanBalance.PaidBy = req.PaidBy
+		loanBalance.SettlementMode = req.SettlementMode
 		loanBalance.CAmt = 0
-		loanBalance.DAmt = repayedAmt
-		loanBalance.LoanBal = 0
-		loanBalance.OpenBal = 0
-
-		loanBalanceBytes, _ = json.Marshal(loanBalance)
-		stub.PutState(args[0], loanBalanceBytes)
-		fmt.Println("written into loan balance ledger")
-
-		repayedAmtString := strconv.FormatInt(repayedAmt, 10)
-		fmt.Printf("Status:%s\n", "collected")
-		chaincodeArgs = toChaincodeArgs("updateLoanInfo", args[1], "collected", repayedAmtString)
-		fmt.Println("calling the other chaincode")
-		response = stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
-		if response.Status != shim.OK {
-			return shim.Error(response.Message)
-		}
+		loanBalance.DAmt = 0
+		loanBalance.LoanBal = loan.LoanBalance
+		loanBalance.RepaidAmt = req.Amt
+		loanBalance.PrincipalAmt = principalAmt
+		loanBalance.CollectedAmt = collectedAmt
+
+		loanReq.Amt = req.Amt
+		loanReq.PrincipalAmt = principalAmt
+		loanReq.LoanStatus = status
+		result = updateLoanBalResult{status, principalAmt, req.Amt - principalAmt, collectedAmt}
+	}
 
-		return shim.Success([]byte(returnVal))
+	//Updating loanBalance ledger
+	loanBalanceBytes, err = json.Marshal(loanBalance)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-	return shim.Success(nil)
+	err = stub.PutState(req.LoanBalID, loanBalanceBytes)
+	if err != nil {
+		return shim.Error("Unable to write the loan balance " + req.LoanBalID + ": " + err.Error())
+	}
+
+	fmt.Printf("Status:%s\n", loanReq.LoanStatus)
+	loanReqBytes, err := json.Marshal(loanReq)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	chaincodeArgs := toChaincodeArgs("updateLoanInfo", req.LoanID, string(loanReqBytes))
+	response := stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return shim.Error(response.Message)
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultBytes)
+}
+
+// loanBalStatus is returned by getLoanBalStatus in loancc
+type loanBalStatus struct {
+	LoanBalance     int64
+	LoanStatus      string
+	SanctionAmt     int64
+	InstNum         string
+	DrawnAmt        int64
+	PrincipalRepaid int64
+	CollectedAmt    int64
+}
+
+func getLoanBalStatus(stub shim.ChaincodeStubInterface, loanID string) (loanBalStatus, error) {
+	loan := loanBalStatus{}
+	chaincodeArgs := toChaincodeArgs("getLoanBalStatus", loanID)
+	fmt.Println("calling the other chaincode")
+	response := stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return loan, errors.New(response.Message)
+	}
+	err := json.Unmarshal(response.Payload, &loan)
+	if err != nil {
+		return loan, errors.New("Unable to parse the loan balance of " + loanID + ": " + err.Error())
+	}
+	return loan, nil
+}
+
+// lookupInstrument calls getInstrument in instrumentcc
+func lookupInstrument(stub shim.ChaincodeStubInterface, instID string) ([]byte, error) {
+	chaincodeArgs := toChaincodeArgs("getInstrument", instID)
+	response := stub.InvokeChaincode("instrumentcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return nil, errors.New("Unable to get the instrument " + instID + ": " + response.Message)
+	}
+	return response.Payload, nil
+}
+
+// decodeRequest parses a JSON request from another chaincode, unknown fields are rejected
+func decodeRequest(reqStr string, req interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(reqStr))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(req)
 }
 
 func toChaincodeArgs(args ...string) [][]byte {
@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
 )
 
 type chainCode struct {
@@ -24,6 +27,27 @@ type pprInfo struct {
 	StaleDays                         int
 	RepaymentAcNo                     string
 	RepaymentWalletID                 string
+	LimitUtilised                     int64 // disbursed and not yet collected
+	LimitBlocked                      int64 // sanctioned and not yet disbursed
+}
+
+// businessWallet is the part of getBusinessInfo in businesscc read by createPPR
+type businessWallet struct {
+	BusinessWalletID string
+}
+
+// walletStatus is the part of getWallet in walletcc read by createPPR
+type walletStatus struct {
+	WalletStatus string
+}
+
+// pprLimitStatus is returned by getPPRLimitStatus
+type pprLimitStatus struct {
+	PPRID                string
+	ProgramBusinessLimit int64
+	Utilised             int64
+	Blocked              int64
+	Available            int64
 }
 
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
@@ -37,19 +61,52 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return createPPR(stub, args)
 	} else if function == "seePPR" {
 		return seePPR(stub, args)
+	} else if function == "reserveLimit" {
+		return reserveLimit(stub, args)
+	} else if function == "drawLimit" {
+		return drawLimit(stub, args)
+	} else if function == "releaseLimit" {
+		return releaseLimit(stub, args)
+	} else if function == "getPPRByBusiness" {
+		return getPPRByBusiness(stub, args)
+	} else if function == "getPPRLimitStatus" {
+		return getPPRLimitStatus(stub, args)
 	}
 	return shim.Error("No function named " + function + " in PPR")
 }
 
 func createPPR(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 10 {
+	if len(args) != 11 {
 		xLenStr := strconv.Itoa(len(args))
-		return shim.Error("Invalid number of arguments in createPPR (required:10) given:" + xLenStr)
+		return shim.Error("Invalid number of arguments in createPPR (required:11) given:" + xLenStr)
 	}
 
 	relationship := map[string]bool{
-		"Seller / Vendor": true,
-		"Buyer / Dealer":  true,
+		"seller / vendor": true,
+		"buyer / dealer":  true,
+	}
+
+	// The program and the business should exist and be active before their PPR
+	_, err := lookupRef(stub, "programcc", "PROGRAM_NOT_FOUND", "program "+args[1], "getProgram", args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	chaincodeArgs := toChaincodeArgs("checkProgramActive", args[1], now.Format("02/01/2006"))
+	response := stub.InvokeChaincode("programcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return shim.Error(response.Message)
+	}
+	businessBytes, err := lookupRef(stub, "businesscc", "BUSINESS_NOT_FOUND", "business "+args[2], "getBusinessInfo", args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkBusinessActive(stub, args[2], businessBytes)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
 	relationshipLower := strings.ToLower(args[3])
@@ -88,9 +145,29 @@ func createPPR(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error(err.Error())
 	}
 
-	ppr := pprInfo{args[1], args[2], relationshipLower, PBLimit, PBroi, PBDperiod, PBDpercentange, sDays, args[9], args[10]}
+	existingID, _, found, err := findPPR(stub, args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if found {
+		return shim.Error("PPR " + existingID + " already exists for program " + args[1] + " and business " + args[2])
+	}
+	pprIndexKey, err := stub.CreateCompositeKey("programID~businessID", []string{args[1], args[2]})
+	if err != nil {
+		return shim.Error("Unable to create programID~businessID composite key:" + err.Error())
+	}
+
+	ppr := pprInfo{args[1], args[2], relationshipLower, PBLimit, PBroi, PBDperiod, PBDpercentange, sDays, args[9], args[10], 0, 0}
 	pprBytes, err := json.Marshal(ppr)
 	err = stub.PutState(args[0], pprBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Index for finding the PPR of a program and business, the value is the pprID
+	err = stub.PutState(pprIndexKey, []byte(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	return shim.Success(nil)
 }
@@ -105,13 +182,357 @@ func seePPR(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	pprArray, err := stub.GetState(args[0])
 	if err != nil {
 		return shim.Error(err.Error())
+	} else if pprArray == nil {
+		return shim.Error("No information on this pprID: " + args[0])
 	}
 
 	err = json.Unmarshal(pprArray, &pprObject)
-	pprString := fmt.Sprintf("%+v", pprObject)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pprArray, err = json.Marshal(pprObject)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(pprArray)
+
+}
+
+func reserveLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *args[1] -> businessID
+	 *args[2] -> Amount sanctioned
+	 *
+	 *Called by loancc on sanction. The amount is blocked against the
+	 *program-business limit till it is disbursed.
+	 */
+	if len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in reserveLimit (required:3) given:" + xLenStr)
+	}
+	err := checkLimitCaller(stub, "reserveLimit")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, err := parseLimitAmt(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pprID, ppr, err := readPPRByBusiness(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	available := availableLimit(ppr)
+	if amt > available {
+		return shim.Error("Sanction of " + args[2] + " breaches the limit of program-business " + pprID + " (limit:" + strconv.FormatInt(ppr.ProgramBusinessLimit, 10) + " utilised:" + strconv.FormatInt(ppr.LimitUtilised, 10) + " blocked:" + strconv.FormatInt(ppr.LimitBlocked, 10) + " available:" + strconv.FormatInt(available, 10) + ")")
+	}
+	ppr.LimitBlocked += amt
+
+	err = writePPR(stub, pprID, ppr)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
 
-	return shim.Success([]byte(pprString))
+func drawLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
+	/*
+	 *args[0] -> programID
+	 *args[1] -> businessID
+	 *args[2] -> Amount disbursed
+	 *
+	 *Called by loancc on disbursement, moves the amount from blocked to utilised
+	 */
+	if len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in drawLimit (required:3) given:" + xLenStr)
+	}
+	err := checkLimitCaller(stub, "drawLimit")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, err := parseLimitAmt(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pprID, ppr, err := readPPRByBusiness(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if amt > ppr.LimitBlocked {
+		return shim.Error("Disbursement of " + args[2] + " is more than the sanctioned amount blocked for program-business " + pprID + " (blocked:" + strconv.FormatInt(ppr.LimitBlocked, 10) + ")")
+	}
+	ppr.LimitBlocked -= amt
+	ppr.LimitUtilised += amt
+
+	err = writePPR(stub, pprID, ppr)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func releaseLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *args[1] -> businessID
+	 *args[2] -> Utilised amount to release
+	 *args[3] -> Blocked amount to release (optional, the undisbursed part of a closed loan)
+	 *
+	 *Called by loancc on collection
+	 */
+	if len(args) != 3 && len(args) != 4 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in releaseLimit (required:3 or 4) given:" + xLenStr)
+	}
+	err := checkLimitCaller(stub, "releaseLimit")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, err := parseLimitAmt(args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var blockedAmt int64
+	if len(args) == 4 {
+		blockedAmt, err = parseLimitAmt(args[3])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	pprID, ppr, err := readPPRByBusiness(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if amt > ppr.LimitUtilised {
+		return shim.Error("Release of " + args[2] + " is more than the limit utilised by program-business " + pprID + " (utilised:" + strconv.FormatInt(ppr.LimitUtilised, 10) + ")")
+	}
+	if blockedAmt > ppr.LimitBlocked {
+		return shim.Error("Release of " + args[3] + " is more than the limit blocked for program-business " + pprID + " (blocked:" + strconv.FormatInt(ppr.LimitBlocked, 10) + ")")
+	}
+	ppr.LimitUtilised -= amt
+	ppr.LimitBlocked -= blockedAmt
+
+	err = writePPR(stub, pprID, ppr)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func getPPRByBusiness(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *args[1] -> businessID
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getPPRByBusiness (required:2) given:" + xLenStr)
+	}
+	_, ppr, err := readPPRByBusiness(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pprBytes, err := json.Marshal(ppr)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(pprBytes)
+}
+
+func getPPRLimitStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *args[1] -> businessID
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getPPRLimitStatus (required:2) given:" + xLenStr)
+	}
+	pprID, ppr, err := readPPRByBusiness(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	limitStatus := pprLimitStatus{pprID, ppr.ProgramBusinessLimit, ppr.LimitUtilised, ppr.LimitBlocked, availableLimit(ppr)}
+	limitStatusBytes, err := json.Marshal(limitStatus)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(limitStatusBytes)
+}
+
+func availableLimit(ppr pprInfo) int64 {
+	return ppr.ProgramBusinessLimit - ppr.LimitUtilised - ppr.LimitBlocked
+}
+
+func parseLimitAmt(amtStr string) (int64, error) {
+	amt, err := strconv.ParseInt(amtStr, 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid amount " + amtStr + ": " + err.Error())
+	}
+	if amt < 0 {
+		return 0, errors.New("Amount cannot be negative: " + amtStr)
+	}
+	return amt, nil
+}
+
+// readPPRByBusiness finds the PPR of a program and business
+func readPPRByBusiness(stub shim.ChaincodeStubInterface, programID string, businessID string) (string, pprInfo, error) {
+	pprID, ppr, found, err := findPPR(stub, programID, businessID)
+	if err != nil {
+		return "", ppr, err
+	} else if !found {
+		return "", ppr, errors.New("No PPR for program " + programID + " and business " + businessID)
+	}
+	return pprID, ppr, nil
+}
+
+// findPPR looks the PPR up in the programID~businessID index, found is false
+// if the business has no PPR in the program
+func findPPR(stub shim.ChaincodeStubInterface, programID string, businessID string) (string, pprInfo, bool, error) {
+	ppr := pprInfo{}
+	pprIndexKey, err := stub.CreateCompositeKey("programID~businessID", []string{programID, businessID})
+	if err != nil {
+		return "", ppr, false, err
+	}
+	pprIDBytes, err := stub.GetState(pprIndexKey)
+	if err != nil {
+		return "", ppr, false, err
+	}
+	if pprIDBytes != nil {
+		pprID := string(pprIDBytes)
+		pprBytes, err := stub.GetState(pprID)
+		if err != nil {
+			return "", ppr, false, err
+		} else if pprBytes == nil {
+			return "", ppr, false, errors.New("No information on this pprID: " + pprID)
+		}
+		err = json.Unmarshal(pprBytes, &ppr)
+		if err != nil {
+			return "", ppr, false, err
+		}
+		return pprID, ppr, true, nil
+	}
+	return "", ppr, false, nil
+}
+
+func writePPR(stub shim.ChaincodeStubInterface, pprID string, ppr pprInfo) error {
+	pprBytes, err := json.Marshal(ppr)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(pprID, pprBytes)
+}
+
+// refError is returned by the referential integrity checks, Code is one of
+// PROGRAM_NOT_FOUND, BUSINESS_NOT_FOUND or BUSINESS_NOT_ACTIVE
+type refError struct {
+	Code string
+	Msg  string
+}
+
+func (e refError) Error() string {
+	return e.Code + ": " + e.Msg
+}
+
+// lookupRef calls a getter of another chaincode to check that a referenced
+// record exists, any failure is reported as a refError of code
+func lookupRef(stub shim.ChaincodeStubInterface, ccName string, code string, what string, args ...string) ([]byte, error) {
+	chaincodeArgs := toChaincodeArgs(args...)
+	response := stub.InvokeChaincode(ccName, chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return nil, refError{code, what + " does not exist (" + response.Message + ")"}
+	}
+	return response.Payload, nil
+}
+
+// checkBusinessActive fails with BUSINESS_NOT_ACTIVE when the main wallet of
+// the business is frozen or closed
+func checkBusinessActive(stub shim.ChaincodeStubInterface, businessID string, businessBytes []byte) error {
+	business := businessWallet{}
+	err := json.Unmarshal(businessBytes, &business)
+	if err != nil {
+		return errors.New("Unable to parse the business " + businessID + ": " + err.Error())
+	}
+	chaincodeArgs := toChaincodeArgs("getWallet", business.BusinessWalletID)
+	response := stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return errors.New("Unable to get the main wallet of business " + businessID + ": " + response.Message)
+	}
+	wallet := walletStatus{}
+	err = json.Unmarshal(response.Payload, &wallet)
+	if err != nil {
+		return errors.New("Unable to parse the main wallet of business " + businessID + ": " + err.Error())
+	}
+	if wallet.WalletStatus != "active" {
+		return refError{"BUSINESS_NOT_ACTIVE", "main wallet of business " + businessID + " is " + wallet.WalletStatus}
+	}
+	return nil
+}
+
+// txnTime is the timestamp of the transaction, the same on every peer
+func txnTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Unable to get the transaction timestamp: " + err.Error())
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+func toChaincodeArgs(args ...string) [][]byte {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	return bargs
+}
+
+// checkLimitCaller fails unless the transaction was proposed to loancc, for a
+// sanction, or to txncc, for a disbursement or repayment. The limits only
+// move with the loans of loancc.
+func checkLimitCaller(stub shim.ChaincodeStubInterface, fcnName string) error {
+	ccName, _, err := proposalChaincode(stub)
+	if err != nil {
+		return err
+	}
+	if ccName != "loancc" && ccName != "txncc" {
+		return errors.New(fcnName + " is only called by loancc, the transaction should be proposed to loancc or txncc, given:" + ccName)
+	}
+	return nil
+}
+
+// proposalChaincode returns the chaincode and function the client invoked in
+// the proposal of this transaction, a chaincode called by another one sees
+// the proposal of the first
+func proposalChaincode(stub shim.ChaincodeStubInterface) (string, string, error) {
+	signedProposal, err := stub.GetSignedProposal()
+	if err != nil {
+		return "", "", errors.New("Unable to get the transaction proposal: " + err.Error())
+	}
+	proposal, err := utils.GetProposal(signedProposal.ProposalBytes)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	invocationSpec, err := utils.GetChaincodeInvocationSpec(proposal)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	spec := invocationSpec.GetChaincodeSpec()
+	if spec.GetChaincodeId() == nil || len(spec.GetInput().GetArgs()) == 0 {
+		return "", "", errors.New("No chaincode invocation in the transaction proposal")
+	}
+	return spec.GetChaincodeId().GetName(), string(spec.GetInput().GetArgs()[0]), nil
 }
 
 func main() {
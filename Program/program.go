@@ -2,13 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/protos/utils"
 )
 
 type chainCode struct {
@@ -29,6 +32,41 @@ type programInfo struct {
 	SanctionDate       time.Time
 	RepaymentAcNum     string
 	RepaymentWalletID  string
+	LimitUtilised      int64  // disbursed and not yet collected
+	LimitBlocked       int64  // sanctioned and not yet disbursed
+	ProgramStatus      string // draft, active, suspended or expired
+	StatusChangedAt    time.Time
+	StatusChangedBy    string
+	Version            int  // latest version of the terms, see programVersion
+	BuyerAcceptance    bool // instruments are financed only once accepted by the buyer
+}
+
+// programTerms are the terms a loan is sanctioned under, every amendment or
+// renewal of them is kept as a new version
+type programTerms struct {
+	ProgramLimit       int64
+	ProgramROI         float64
+	DiscountPercentage float64
+	DiscountPeriod     int
+	ProgramEndDate     time.Time
+}
+
+// programVersion is one entry of getProgramVersions
+type programVersion struct {
+	Version    int
+	ChangeType string // created, amended or renewed
+	Terms      programTerms
+	TxnID      string
+	ModifiedBy string
+	ModifiedAt time.Time
+}
+
+// programLimitStatus is returned by getProgramLimitStatus
+type programLimitStatus struct {
+	ProgramLimit int64
+	Utilised     int64
+	Blocked      int64
+	Available    int64
 }
 
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
@@ -42,17 +80,45 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return writeProgram(stub, args)
 	} else if function == "getProgram" {
 		return getProgram(stub, args)
+	} else if function == "amendProgram" {
+		return amendProgram(stub, args)
+	} else if function == "renewProgram" {
+		return renewProgram(stub, args)
+	} else if function == "getProgramVersions" {
+		return getProgramVersions(stub, args)
+	} else if function == "activateProgram" {
+		return activateProgram(stub, args)
+	} else if function == "suspendProgram" {
+		return suspendProgram(stub, args)
+	} else if function == "checkProgramExpiry" {
+		return checkProgramExpiry(stub, args)
+	} else if function == "checkProgramActive" {
+		return checkProgramActive(stub, args)
+	} else if function == "reserveLimit" {
+		return reserveLimit(stub, args)
+	} else if function == "drawLimit" {
+		return drawLimit(stub, args)
+	} else if function == "releaseLimit" {
+		return releaseLimit(stub, args)
+	} else if function == "getProgramLimitStatus" {
+		return getProgramLimitStatus(stub, args)
 	}
 	return shim.Error("No function named " + function + " in Program")
 }
 
 func writeProgram(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 13 {
+	if len(args) != 15 && len(args) != 16 {
 		xLenStr := strconv.Itoa(len(args))
-		return shim.Error("Invalid number of arguments in writeProgram (required:13) given:" + xLenStr)
+		return shim.Error("Invalid number of arguments in writeProgram (required:15 or 16) given:" + xLenStr)
 	}
 
 	//args[0] -> programID ; Key for the structure, must be passed by the user
+	ifExists, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if ifExists != nil {
+		return shim.Error("ProgramID " + args[0] + " exists, use amendProgram or renewProgram to change it")
+	}
 
 	pTypes := map[string]bool{
 		"ar": true,
@@ -115,9 +181,39 @@ func writeProgram(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error(err.Error())
 	}
 
-	pInfo := programInfo{args[1], args[2], pTypeLower, pSDate, pEDate, pLimit, pROI, pExposureLower, dPercentage, dPeriod, args[11], sDate, args[13], args[14]}
+	if pEDate.Before(pSDate) {
+		return shim.Error("Program end date " + args[5] + " is before the start date " + args[4])
+	}
+
+	//args[15] -> BuyerAcceptance, optional and false by default
+	buyerAcceptance := false
+	if len(args) == 16 {
+		buyerAcceptance, err = strconv.ParseBool(args[15])
+		if err != nil {
+			return shim.Error("Invalid buyer acceptance " + args[15])
+		}
+	}
+
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	createdBy, err := cid.GetID(stub)
+	if err != nil {
+		return shim.Error("Unable to get the identity of the caller: " + err.Error())
+	}
+
+	// Every program starts as a draft and is used only after activateProgram
+	pInfo := programInfo{args[1], args[2], pTypeLower, pSDate, pEDate, pLimit, pROI, pExposureLower, dPercentage, dPeriod, args[11], sDate, args[13], args[14], 0, 0, "draft", now, createdBy, 1, buyerAcceptance}
 	programInfoBytes, _ := json.Marshal(pInfo)
 	err = stub.PutState(args[0], programInfoBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = writeProgramVersion(stub, args[0], pInfo, "created", createdBy, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -142,10 +238,647 @@ func getProgram(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error(err.Error())
 	}
 
-	printProgramInfo := fmt.Sprintf("%+v", pInfo)
+	pInfoBytes, err = json.Marshal(pInfo)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(pInfoBytes)
+
+}
+
+func amendProgram(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> programID
+	*args[1],args[2] ... -> pairs of field name and new value
+	*
+	*Fields that can be changed: ProgramLimit, ProgramROI, DiscountPercentage,
+	*DiscountPeriod, ProgramEndDate (dd/mm/yyyy)
+	*Loans already sanctioned keep the version they were sanctioned under.
+	*The caller needs the role=admin attribute in its certificate.
+	 */
+	if len(args) < 3 || len(args)%2 != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in amendProgram (required: programID followed by field,value pairs) given:" + xLenStr)
+	}
+	err := checkAdmin(stub, "amend a program")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		switch args[i] {
+		case "ProgramLimit":
+			program.ProgramLimit, err = strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return shim.Error("Invalid Program limit " + args[i+1])
+			}
+			if program.ProgramLimit < program.LimitUtilised+program.LimitBlocked {
+				return shim.Error("Program limit " + args[i+1] + " is less than the limit in use " + strconv.FormatInt(program.LimitUtilised+program.LimitBlocked, 10))
+			}
+		case "ProgramROI":
+			program.ProgramROI, err = strconv.ParseFloat(args[i+1], 32)
+			if err != nil {
+				return shim.Error("Invalid Rate of Interest " + args[i+1])
+			}
+		case "DiscountPercentage":
+			program.DiscountPercentage, err = strconv.ParseFloat(args[i+1], 32)
+			if err != nil {
+				return shim.Error("Invalid discount percentage " + args[i+1])
+			}
+		case "DiscountPeriod":
+			program.DiscountPeriod, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return shim.Error("Invalid discount period " + args[i+1])
+			}
+		case "ProgramEndDate":
+			program.ProgramEndDate, err = time.Parse("02/01/2006", args[i+1])
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if program.ProgramEndDate.Before(program.ProgramStartDate) {
+				return shim.Error("Program end date " + args[i+1] + " is before the start date")
+			}
+		default:
+			return shim.Error("Field " + args[i] + " cannot be amended in amendProgram")
+		}
+	}
+
+	err = newProgramVersion(stub, args[0], program, "amended")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Program " + args[0] + " amended to version " + strconv.Itoa(program.Version+1)))
+}
+
+func renewProgram(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> programID
+	*args[1] -> New ProgramEndDate (dd/mm/yyyy), after the current one
+	*args[2] -> New ProgramLimit (optional)
+	*
+	*An expired program becomes active again. The caller needs the role=admin
+	*attribute in its certificate.
+	 */
+	if len(args) != 2 && len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in renewProgram (required:2 or 3) given:" + xLenStr)
+	}
+	err := checkAdmin(stub, "renew a program")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	endDate, err := time.Parse("02/01/2006", args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !endDate.After(program.ProgramEndDate) {
+		return shim.Error("Renewed end date " + args[1] + " should be after the current end date " + program.ProgramEndDate.Format("02/01/2006"))
+	}
+	if len(args) == 3 {
+		program.ProgramLimit, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return shim.Error("Invalid Program limit " + args[2])
+		}
+		if program.ProgramLimit < program.LimitUtilised+program.LimitBlocked {
+			return shim.Error("Program limit " + args[2] + " is less than the limit in use " + strconv.FormatInt(program.LimitUtilised+program.LimitBlocked, 10))
+		}
+	}
+
+	wasExpired := programStatus(program, now) == "expired"
+	program.ProgramEndDate = endDate
+	if wasExpired && !programExpired(program, now) {
+		program.ProgramStatus = "active"
+		program.StatusChangedAt = now
+	}
+
+	err = newProgramVersion(stub, args[0], program, "renewed")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte("Program " + args[0] + " renewed to version " + strconv.Itoa(program.Version+1)))
+}
+
+func getProgramVersions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getProgramVersions (required:1) given:" + xLenStr)
+	}
+	_, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	versionIterator, err := stub.GetStateByPartialCompositeKey("programID~version", []string{args[0]})
+	if err != nil {
+		return shim.Error("Unable to get the versions of program " + args[0] + ": " + err.Error())
+	}
+	defer versionIterator.Close()
+
+	versions := []programVersion{}
+	for versionIterator.HasNext() {
+		versionData, err := versionIterator.Next()
+		if err != nil {
+			return shim.Error("Unable to iterate versionIterator:" + err.Error())
+		}
+		version := programVersion{}
+		err = json.Unmarshal(versionData.Value, &version)
+		if err != nil {
+			return shim.Error("Unable to parse the versions of program " + args[0] + ": " + err.Error())
+		}
+		versions = append(versions, version)
+	}
+
+	versionsBytes, err := json.Marshal(versions)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(versionsBytes)
+}
+
+// newProgramVersion writes the program with its terms as the next version
+func newProgramVersion(stub shim.ChaincodeStubInterface, programID string, program programInfo, changeType string) error {
+	modifiedBy, err := cid.GetID(stub)
+	if err != nil {
+		return errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return err
+	}
+
+	program.Version++
+	err = writeProgramInfo(stub, programID, program)
+	if err != nil {
+		return err
+	}
+	return writeProgramVersion(stub, programID, program, changeType, modifiedBy, now)
+}
+
+func writeProgramVersion(stub shim.ChaincodeStubInterface, programID string, program programInfo, changeType string, modifiedBy string, now time.Time) error {
+	// zero padded so that the versions are listed in order
+	versionKey, err := stub.CreateCompositeKey("programID~version", []string{programID, fmt.Sprintf("%06d", program.Version)})
+	if err != nil {
+		return errors.New("Unable to create programID~version composite key:" + err.Error())
+	}
+	version := programVersion{program.Version, changeType, termsOf(program), stub.GetTxID(), modifiedBy, now}
+	versionBytes, err := json.Marshal(version)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(versionKey, versionBytes)
+}
+
+func termsOf(program programInfo) programTerms {
+	return programTerms{program.ProgramLimit, program.ProgramROI, program.DiscountPercentage, program.DiscountPeriod, program.ProgramEndDate}
+}
+
+func activateProgram(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *
+	 *A draft or suspended program becomes active, unless its end date has passed.
+	 *The caller needs the role=admin attribute in its certificate.
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in activateProgram (required:1) given:" + xLenStr)
+	}
+	err := checkAdmin(stub, "activate a program")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	status := programStatus(program, now)
+	if status != "draft" && status != "suspended" {
+		return shim.Error(refError{"PROGRAM_NOT_ACTIVATABLE", "program " + args[0] + " is " + status}.Error())
+	}
+	if programExpired(program, now) {
+		return shim.Error(refError{"PROGRAM_EXPIRED", "program " + args[0] + " ended on " + program.ProgramEndDate.Format("02/01/2006")}.Error())
+	}
+
+	err = setProgramStatus(stub, args[0], program, "active", now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func suspendProgram(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *
+	 *No instruments or loans can be added to a suspended program till it is
+	 *activated again. The caller needs the role=admin attribute in its
+	 *certificate.
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in suspendProgram (required:1) given:" + xLenStr)
+	}
+	err := checkAdmin(stub, "suspend a program")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	status := programStatus(program, now)
+	if status != "active" {
+		return shim.Error(refError{"PROGRAM_NOT_ACTIVE", "program " + args[0] + " is " + status}.Error())
+	}
+
+	err = setProgramStatus(stub, args[0], program, "suspended", now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func checkProgramExpiry(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *
+	 *Marks the program expired once its end date has passed, the payload is
+	 *the status of the program after the check
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in checkProgramExpiry (required:1) given:" + xLenStr)
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if program.ProgramStatus != "expired" && programExpired(program, now) {
+		err = setProgramStatus(stub, args[0], program, "expired", now)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success([]byte("expired"))
+	}
+	return shim.Success([]byte(programStatus(program, now)))
+}
+
+func checkProgramActive(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *args[1] -> Date of the instrument or loan (dd/mm/yyyy)
+	 *
+	 *Called by instrumentcc and loancc. Fails with PROGRAM_NOT_FOUND,
+	 *PROGRAM_NOT_ACTIVE, PROGRAM_SUSPENDED, PROGRAM_EXPIRED or
+	 *OUTSIDE_PROGRAM_WINDOW.
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in checkProgramActive (required:2) given:" + xLenStr)
+	}
+	date, err := time.Parse("02/01/2006", args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(refError{"PROGRAM_NOT_FOUND", err.Error()}.Error())
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	switch programStatus(program, now) {
+	case "active":
+	case "suspended":
+		return shim.Error(refError{"PROGRAM_SUSPENDED", "program " + args[0] + " is suspended"}.Error())
+	case "expired":
+		return shim.Error(refError{"PROGRAM_EXPIRED", "program " + args[0] + " ended on " + program.ProgramEndDate.Format("02/01/2006")}.Error())
+	default:
+		return shim.Error(refError{"PROGRAM_NOT_ACTIVE", "program " + args[0] + " is " + program.ProgramStatus}.Error())
+	}
+
+	if date.Before(program.ProgramStartDate) || date.After(program.ProgramEndDate) {
+		return shim.Error(refError{"OUTSIDE_PROGRAM_WINDOW", args[1] + " is outside program " + args[0] + " (" + program.ProgramStartDate.Format("02/01/2006") + " to " + program.ProgramEndDate.Format("02/01/2006") + ")"}.Error())
+	}
+	return shim.Success(nil)
+}
+
+// programStatus is the stored status, an active program is expired once its
+// end date has passed even before checkProgramExpiry marks it
+func programStatus(program programInfo, now time.Time) string {
+	if program.ProgramStatus == "active" && programExpired(program, now) {
+		return "expired"
+	}
+	return program.ProgramStatus
+}
+
+// programExpired is true from the day after ProgramEndDate
+func programExpired(program programInfo, now time.Time) bool {
+	return !now.Before(program.ProgramEndDate.AddDate(0, 0, 1))
+}
+
+func setProgramStatus(stub shim.ChaincodeStubInterface, programID string, program programInfo, status string, now time.Time) error {
+	changedBy, err := cid.GetID(stub)
+	if err != nil {
+		return errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+	program.ProgramStatus = status
+	program.StatusChangedAt = now
+	program.StatusChangedBy = changedBy
+	err = writeProgramInfo(stub, programID, program)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Program %s is %s\n", programID, status)
+	return nil
+}
+
+// checkAdmin fails unless the caller has the role=admin attribute in its
+// certificate, action says what the caller tried to do
+func checkAdmin(stub shim.ChaincodeStubInterface, action string) error {
+	role, found, err := cid.GetAttributeValue(stub, "role")
+	if err != nil {
+		return errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+	if !found || role != "admin" {
+		return errors.New("Only an admin can " + action)
+	}
+	return nil
+}
+
+func txnTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Unable to get the transaction timestamp: " + err.Error())
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// refError carries the error code checked by the callers of programcc
+type refError struct {
+	Code string
+	Msg  string
+}
+
+func (e refError) Error() string {
+	return e.Code + ": " + e.Msg
+}
+
+func reserveLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *args[1] -> Amount sanctioned
+	 *
+	 *Called by loancc on sanction. The amount is blocked against the
+	 *program limit till it is disbursed.
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in reserveLimit (required:2) given:" + xLenStr)
+	}
+	err := checkLimitCaller(stub, "reserveLimit")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, err := parseLimitAmt(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	available := availableLimit(program)
+	if amt > available {
+		return shim.Error("Sanction of " + args[1] + " breaches the limit of program " + args[0] + " (limit:" + strconv.FormatInt(program.ProgramLimit, 10) + " utilised:" + strconv.FormatInt(program.LimitUtilised, 10) + " blocked:" + strconv.FormatInt(program.LimitBlocked, 10) + " available:" + strconv.FormatInt(available, 10) + ")")
+	}
+	program.LimitBlocked += amt
+
+	err = writeProgramInfo(stub, args[0], program)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func drawLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *args[1] -> Amount disbursed
+	 *
+	 *Called by loancc on disbursement, moves the amount from blocked to utilised
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in drawLimit (required:2) given:" + xLenStr)
+	}
+	err := checkLimitCaller(stub, "drawLimit")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, err := parseLimitAmt(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if amt > program.LimitBlocked {
+		return shim.Error("Disbursement of " + args[1] + " is more than the sanctioned amount blocked for program " + args[0] + " (blocked:" + strconv.FormatInt(program.LimitBlocked, 10) + ")")
+	}
+	program.LimitBlocked -= amt
+	program.LimitUtilised += amt
+
+	err = writeProgramInfo(stub, args[0], program)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func releaseLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	 *args[0] -> programID
+	 *args[1] -> Utilised amount to release
+	 *args[2] -> Blocked amount to release (optional, the undisbursed part of a closed loan)
+	 *
+	 *Called by loancc on collection
+	 */
+	if len(args) != 2 && len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in releaseLimit (required:2 or 3) given:" + xLenStr)
+	}
+	err := checkLimitCaller(stub, "releaseLimit")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amt, err := parseLimitAmt(args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var blockedAmt int64
+	if len(args) == 3 {
+		blockedAmt, err = parseLimitAmt(args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if amt > program.LimitUtilised {
+		return shim.Error("Release of " + args[1] + " is more than the limit utilised by program " + args[0] + " (utilised:" + strconv.FormatInt(program.LimitUtilised, 10) + ")")
+	}
+	if blockedAmt > program.LimitBlocked {
+		return shim.Error("Release of " + args[2] + " is more than the limit blocked for program " + args[0] + " (blocked:" + strconv.FormatInt(program.LimitBlocked, 10) + ")")
+	}
+	program.LimitUtilised -= amt
+	program.LimitBlocked -= blockedAmt
+
+	err = writeProgramInfo(stub, args[0], program)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func getProgramLimitStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getProgramLimitStatus (required:1) given:" + xLenStr)
+	}
+	program, err := readProgram(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	limitStatus := programLimitStatus{program.ProgramLimit, program.LimitUtilised, program.LimitBlocked, availableLimit(program)}
+	limitStatusBytes, err := json.Marshal(limitStatus)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(limitStatusBytes)
+}
+
+func availableLimit(program programInfo) int64 {
+	return program.ProgramLimit - program.LimitUtilised - program.LimitBlocked
+}
+
+func parseLimitAmt(amtStr string) (int64, error) {
+	amt, err := strconv.ParseInt(amtStr, 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid amount " + amtStr + ": " + err.Error())
+	}
+	if amt < 0 {
+		return 0, errors.New("Amount cannot be negative: " + amtStr)
+	}
+	return amt, nil
+}
+
+func readProgram(stub shim.ChaincodeStubInterface, programID string) (programInfo, error) {
+	program := programInfo{}
+	programBytes, err := stub.GetState(programID)
+	if err != nil {
+		return program, err
+	} else if programBytes == nil {
+		return program, errors.New("No information on this programID: " + programID)
+	}
+	err = json.Unmarshal(programBytes, &program)
+	if err != nil {
+		return program, err
+	}
+	return program, nil
+}
+
+func writeProgramInfo(stub shim.ChaincodeStubInterface, programID string, program programInfo) error {
+	programBytes, err := json.Marshal(program)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(programID, programBytes)
+}
 
-	return shim.Success([]byte(printProgramInfo))
+// checkLimitCaller fails unless the transaction was proposed to loancc, for a
+// sanction, or to txncc, for a disbursement or repayment. The limits only
+// move with the loans of loancc.
+func checkLimitCaller(stub shim.ChaincodeStubInterface, fcnName string) error {
+	ccName, _, err := proposalChaincode(stub)
+	if err != nil {
+		return err
+	}
+	if ccName != "loancc" && ccName != "txncc" {
+		return errors.New(fcnName + " is only called by loancc, the transaction should be proposed to loancc or txncc, given:" + ccName)
+	}
+	return nil
+}
 
+// proposalChaincode returns the chaincode and function the client invoked in
+// the proposal of this transaction, a chaincode called by another one sees
+// the proposal of the first
+func proposalChaincode(stub shim.ChaincodeStubInterface) (string, string, error) {
+	signedProposal, err := stub.GetSignedProposal()
+	if err != nil {
+		return "", "", errors.New("Unable to get the transaction proposal: " + err.Error())
+	}
+	proposal, err := utils.GetProposal(signedProposal.ProposalBytes)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	invocationSpec, err := utils.GetChaincodeInvocationSpec(proposal)
+	if err != nil {
+		return "", "", errors.New("Unable to parse the transaction proposal: " + err.Error())
+	}
+	spec := invocationSpec.GetChaincodeSpec()
+	if spec.GetChaincodeId() == nil || len(spec.GetInput().GetArgs()) == 0 {
+		return "", "", errors.New("No chaincode invocation in the transaction proposal")
+	}
+	return spec.GetChaincodeId().GetName(), string(spec.GetInput().GetArgs()[0]), nil
 }
 
 func main() {
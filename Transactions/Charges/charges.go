@@ -1,9 +1,9 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
-	"strings"
 
 	"github.com/hyperledger/fabric/common/util"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -13,6 +13,24 @@ import (
 type chainCode struct {
 }
 
+// txnBalRequest is sent to creditWallet in walletcc as JSON, walletcc fills in
+// the wallet, amounts and balances before writing it into txnbalcc
+type txnBalRequest struct {
+	TxnBalID   string
+	TxnID      string
+	TxnDate    string // dd/mm/yyyy
+	LoanID     string
+	InsID      string
+	WalletID   string
+	OpeningBal int64
+	TxnType    string
+	Amt        int64
+	CAmt       int64
+	DAmt       int64
+	TxnBal     int64
+	By         string
+}
+
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
@@ -28,8 +46,8 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 
 func putTxnBalInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	/*
-	 * arg[0]	:	Key
-	 * arg[1]	:	txnID	(0)
+	 * arg[0]	:	Key (the Fabric txn ID and the row number)
+	 * arg[1]	:	txnID	(the Fabric txn ID)
 	 * arg[2]	:	date					//given	args[0]
 	 * arg[3]	:	LoanID					//given	args[1]
 	 * arg[4]	:	insID					//given args[2]
@@ -73,47 +91,15 @@ func putTxnBalInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error(response.Message)
 	}
 	walletID := string(response.Payload)
+	var err error
 
 	// STEP-2
-	// getting Balance from walletID
-	// walletFcn := "getWallet"
-	walletArgs := util.ToChaincodeArgs("getWallet", walletID)
-	walletResponse := stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error(walletResponse.Message)
-	}
-	openBalString := string(walletResponse.Payload)
-	openBal, err := strconv.ParseInt(openBalString, 10, 64)
+	// crediting the wallet of ID walletID, walletcc writes the txn_balance_object
+	// to the Txn_Bal_Ledger
+	err = creditWallet(stub, walletID, args[5], txnBalRequest{TxnBalID: stub.GetTxID() + "_1", TxnID: stub.GetTxID(), TxnDate: args[0], LoanID: args[1], InsID: args[2], TxnType: args[7], By: args[6]})
 	if err != nil {
-		return shim.Error("Error in converting the balance")
+		return shim.Error(err.Error())
 	}
-
-	cAmtString := args[5]
-	cAmt, _ := strconv.ParseInt(cAmtString, 10, 64)
-	dAmtString := "0"
-	dAmt, _ := strconv.ParseInt(dAmtString, 10, 64)
-	txnBal := openBal - dAmt + cAmt
-	txnBalString := strconv.FormatInt(txnBal, 10)
-
-	// STEP-3
-	// update wallet of ID walletID here, and write it to the wallet_ledger
-	// walletFcn := "updateWallet"
-	walletArgs = util.ToChaincodeArgs("updateWallet", walletID, txnBalString)
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error(walletResponse.Message)
-	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList := []string{"1", "0", args[0], args[1], args[2], walletID, openBalString, args[7], args[5], cAmtString, dAmtString, txnBalString, args[6]}
-	argsListStr := strings.Join(argsList, ",")
-	chaincodeArgs = util.ToChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
-	}
-	fmt.Println(response.GetPayload())
 	//successfully updated Bank's main wallet and written the txn thing to the ledger
 	//+++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
@@ -135,45 +121,12 @@ func putTxnBalInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	walletID = string(response.Payload[:])
 
 	// STEP-2
-	// getting Balance from walletID
-	// walletFcn := "getWallet"
-	walletArgs = util.ToChaincodeArgs("getWallet", walletID)
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error(walletResponse.Message)
-	}
-	openBalString = string(walletResponse.Payload[:])
-	openBal, err = strconv.ParseInt(openBalString, 10, 64)
+	// crediting the wallet of ID walletID, walletcc writes the txn_balance_object
+	// to the Txn_Bal_Ledger
+	err = creditWallet(stub, walletID, args[4], txnBalRequest{TxnBalID: stub.GetTxID() + "_2", TxnID: stub.GetTxID(), TxnDate: args[0], LoanID: args[1], InsID: args[2], TxnType: args[7], By: args[5]})
 	if err != nil {
-		return shim.Error("Error in converting the balance")
+		return shim.Error(err.Error())
 	}
-
-	cAmtString = args[4]
-	cAmt, _ = strconv.ParseInt(cAmtString, 10, 64)
-	dAmtString = "0"
-	dAmt, _ = strconv.ParseInt(dAmtString, 10, 64)
-	txnBal = openBal - dAmt + cAmt
-	txnBalString = strconv.FormatInt(txnBal, 10)
-
-	// STEP-3
-	// update wallet of ID walletID here, and write it to the wallet_ledger
-	// walletFcn := "updateWallet"
-	walletArgs = util.ToChaincodeArgs("updateWallet", walletID, txnBalString)
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error(walletResponse.Message)
-	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"2", "0", args[0], args[1], args[2], walletID, openBalString, args[7], args[4], cAmtString, dAmtString, txnBalString, args[5]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = util.ToChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
-	}
-	fmt.Println(response.GetPayload())
 	//successfully updated Bank's main wallet and written the txn thing to the ledger
 	//+++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
@@ -195,51 +148,33 @@ func putTxnBalInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	walletID = string(response.Payload[:])
 
 	// STEP-2
-	// getting Balance from walletID
-	// walletFcn := "getWallet"
-	walletArgs = util.ToChaincodeArgs("getWallet", walletID)
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error(walletResponse.Message)
-	}
-	openBalString = string(walletResponse.Payload[:])
-	openBal, err = strconv.ParseInt(openBalString, 10, 64)
+	// crediting the wallet of ID walletID, walletcc writes the txn_balance_object
+	// to the Txn_Bal_Ledger
+	err = creditWallet(stub, walletID, args[4], txnBalRequest{TxnBalID: stub.GetTxID() + "_3", TxnID: stub.GetTxID(), TxnDate: args[0], LoanID: args[1], InsID: args[2], TxnType: args[7], By: args[5]})
 	if err != nil {
-		return shim.Error("Error in converting the balance")
-	}
-
-	cAmtString = args[4]
-	cAmt, _ = strconv.ParseInt(cAmtString, 10, 64)
-	dAmtString = "0"
-	dAmt, _ = strconv.ParseInt(dAmtString, 10, 64)
-	txnBal = openBal - dAmt + cAmt
-	txnBalString = strconv.FormatInt(txnBal, 10)
-
-	// STEP-3
-	// update wallet of ID walletID here, and write it to the wallet_ledger
-	// walletFcn := "updateWallet"
-	walletArgs = util.ToChaincodeArgs("updateWallet", walletID, txnBalString)
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error(walletResponse.Message)
-	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"3", "0", args[0], args[1], args[2], walletID, openBalString, args[7], args[4], cAmtString, dAmtString, txnBalString, args[5]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = util.ToChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+		return shim.Error(err.Error())
 	}
-	fmt.Println(response.GetPayload())
 	//successfully updated Bank's main wallet and written the txn thing to the ledger
 	//+++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 	return shim.Success(nil)
 }
 
+// creditWallet credits amtStr to the wallet through walletcc, which writes
+// the Transaction Balance row from txnBal
+func creditWallet(stub shim.ChaincodeStubInterface, walletID string, amtStr string, txnBal txnBalRequest) error {
+	txnBalBytes, err := json.Marshal(txnBal)
+	if err != nil {
+		return err
+	}
+	walletArgs := util.ToChaincodeArgs("creditWallet", walletID, amtStr, string(txnBalBytes))
+	walletResponse := stub.InvokeChaincode("walletcc", walletArgs, "myc")
+	if walletResponse.Status != shim.OK {
+		return errors.New(walletResponse.Message)
+	}
+	return nil
+}
+
 func main() {
 	err := shim.Start(new(chainCode))
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -13,6 +14,83 @@ import (
 type chainCode struct {
 }
 
+// txnRequest is sent by txncc to newDisbInfo as JSON
+type txnRequest struct {
+	TxnID   string
+	TxnType string
+	TxnDate string // dd/mm/yyyy
+	LoanID  string
+	InsID   string
+	Amt     int64
+	FromID  string // Bank
+	ToID    string // Business
+	By      string
+	PprID   string
+}
+
+// updateLoanBalRequest is sent to updateLoanBal in loanbalcc as JSON
+type updateLoanBalRequest struct {
+	LoanBalID string
+	LoanID    string
+	TxnID     string
+	TxnDate   string // dd/mm/yyyy
+	TxnType   string
+	CAmt      int64
+	DAmt      int64
+	Amt       int64
+	InsID     string
+	Mode      string // disb or inst
+}
+
+// updateLoanBalResult is returned by updateLoanBal in loanbalcc
+type updateLoanBalResult struct {
+	LoanStatus   string
+	PrincipalAmt int64
+	RefundAmt    int64
+	CollectedAmt int64
+}
+
+// journalRequest is sent to postJournal in walletcc as JSON
+type journalRequest struct {
+	TxnID   string
+	TxnDate string // dd/mm/yyyy
+	LoanID  string
+	InsID   string
+	TxnType string
+	By      string
+	Legs    []journalLeg
+}
+
+// instrumentParties is the part of getInstrument in instrumentcc used here
+type instrumentParties struct {
+	InstrumentRefNo string
+	SellBusinessID  string
+	BuyBusinsessID  string
+	ProgramID       string
+}
+
+// loanBalStatus is returned by getLoanBalStatus in loancc
+type loanBalStatus struct {
+	LoanBalance int64
+	LoanStatus  string
+	SanctionAmt int64
+	InstNum     string
+	BankID      string // lending bank, its main wallet holds the undisbursed sanction
+}
+
+// programType is the part of getProgram in programcc used here
+type programType struct {
+	ProgramType string
+}
+
+// journalLeg is one leg of a postJournal call in walletcc
+type journalLeg struct {
+	WalletID string
+	DAmt     int64
+	CAmt     int64
+	HoldID   string
+}
+
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
@@ -28,148 +106,150 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 
 func newDisbInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) == 1 {
-		args = strings.Split(args[0], ",")
-	}
-	if len(args) != 10 {
+	/*
+	 *args[0] -> txnRequest as JSON, sent by txncc
+	 */
+	if len(args) != 1 {
 		xLenStr := strconv.Itoa(len(args))
-		return shim.Error("Invalid number of arguments in newDisbInfo(disbursement) (required:10) given:" + xLenStr)
+		return shim.Error("Invalid number of arguments in newDisbInfo(disbursement) (required:1) given:" + xLenStr)
 	}
 
-	/*
-	 *TxnType string    //args[1]
-	 *TxnDate time.Time //args[2]
-	 *LoanID  string    //args[3]
-	 *InsID   string    //args[4]
-	 *Amt     int64     //args[5]
-	 *FromID  string    //args[6]
-	 *ToID    string    //args[7]
-	 *By      string    //args[8]
-	 *PprID   string    //args[9]
-	 */
+	txn := txnRequest{}
+	err := decodeRequest(args[0], &txn)
+	if err != nil {
+		return shim.Error("Invalid request in newDisbInfo(disbursement): " + err.Error())
+	}
+	if txn.TxnID == "" || txn.TxnDate == "" || txn.LoanID == "" || txn.InsID == "" || txn.FromID == "" || txn.ToID == "" {
+		return shim.Error("TxnID, TxnDate, LoanID, InsID, FromID and ToID are required in newDisbInfo(disbursement)")
+	}
+	if txn.Amt <= 0 {
+		return shim.Error("Amt should be greater than zero in newDisbInfo(disbursement)")
+	}
 
 	///////////////////////////////////////////////////////////////////////////////////////////////////
 	// 				UPDATING WALLETS																///
 	///////////////////////////////////////////////////////////////////////////////////////////////////
-	// The transaction object has been created and written into the ledger
-	// The JSON file is 'transaction'function
-	// Now to create a TXN_Bal_Update obj for 4 times
-	// Calling TXN_Balance CC based on TXN_Type {ex: Disbursement}
+	// All the legs are posted as one balanced journal in walletcc, which
+	// writes the TxnBalance rows of every leg
 	/*
 	 *	bank main wallet reduced
-	 * 	bank asset wallet incresed
-	 *	business main wallet increased
-	 *	business loan wallet increased
+	 *	business (payee) main wallet increased
+	 * 	bank asset wallet increased
+	 *	borrower loan wallet reduced, the loan wallet carries the debt as a negative balance
+	 *	in an AP program, supplier liability wallet reduced and anchor liability
+	 *	wallet increased, the supplier carries the liability on the instrument
+	 *	paid early till the anchor settles it
 	 */
 
-	//####################################################################################################################
-	//Calling for updating Bank Main_Wallet
-	//####################################################################################################################
-
-	cAmtString := "0"
-	dAmtString := args[5]
-
-	walletID, openBalString, txnBalString, err := getWalletInfo(stub, args[6], "main", "bankcc", cAmtString, dAmtString)
+	// In a dealer finance (df) program the anchor (seller) is paid and the
+	// dealer (buyer) is the borrower, in a reverse factoring (ap) program the
+	// supplier (seller) is paid early, otherwise the business paid is the
+	// borrower
+	loan, ins, programType, err := getInstrumentProgram(stub, txn)
 	if err != nil {
-		return shim.Error("Bank Main Wallet(Disbursement):" + err.Error())
+		return shim.Error("Instrument " + txn.InsID + " (Disbursement):" + err.Error())
 	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList := []string{"1", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr := strings.Join(argsList, ",")
-	chaincodeArgs := toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response := stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+	// The bank disbursing is the bank holding the sanction, loans sanctioned
+	// before the hold have no bank on them
+	if loan.BankID != "" && txn.FromID != loan.BankID {
+		return shim.Error("Loan " + txn.LoanID + " is sanctioned by bank " + loan.BankID + ", given:" + txn.FromID)
+	}
+	borrowerID := txn.ToID
+	switch programType {
+	case "df":
+		if txn.ToID != ins.SellBusinessID {
+			return shim.Error("Dealer finance disbursement should be paid to the anchor " + ins.SellBusinessID + ", given:" + txn.ToID)
+		}
+		borrowerID = ins.BuyBusinsessID
+	case "ap":
+		if txn.ToID != ins.SellBusinessID {
+			return shim.Error("AP disbursement should be paid to the supplier " + ins.SellBusinessID + ", given:" + txn.ToID)
+		}
 	}
-	fmt.Println(string(response.GetPayload()))
-
-	//#####################################################################################################################
-	//Calling for updating Business Main_Wallet
-	//####################################################################################################################
-
-	cAmtString = args[5]
-	dAmtString = "0"
 
-	walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[7], "main", "businesscc", cAmtString, dAmtString)
+	bankWalletID, err := getWalletIDonly(stub, "bankcc", txn.FromID, "main")
+	if err != nil {
+		return shim.Error("Bank Main Wallet(Disbursement):" + err.Error())
+	}
+	businessWalletID, err := getWalletIDonly(stub, "businesscc", txn.ToID, "main")
 	if err != nil {
 		return shim.Error("Business Main Wallet(Disbursement):" + err.Error())
 	}
 
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"2", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+	bankAssetWalletID, err := getWalletIDonly(stub, "bankcc", txn.FromID, "asset")
+	if err != nil {
+		return shim.Error("Bank Asset Wallet(Disbursement):" + err.Error())
 	}
-	fmt.Println(string(response.GetPayload()))
-
-	//####################################################################################################################
-	//Calling for updating Business Loan_Wallet
-	//####################################################################################################################
-
-	cAmtString = args[5]
-	dAmtString = "0"
-
-	walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[7], "loan", "businesscc", cAmtString, dAmtString)
+	loanWalletID, err := getWalletIDonly(stub, "businesscc", borrowerID, "loan")
 	if err != nil {
-		return shim.Error("Business Loan Wallet(Disbursement)" + err.Error())
+		return shim.Error("Business Loan Wallet(Disbursement):" + err.Error())
 	}
 
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"3", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+	// The bank pays out of the hold placed on its main wallet at sanction
+	holdID := ""
+	if loan.BankID != "" {
+		holdID = txn.LoanID
+	}
+	legs := []journalLeg{
+		{bankWalletID, txn.Amt, 0, holdID},
+		{businessWalletID, 0, txn.Amt, ""},
+		{bankAssetWalletID, 0, txn.Amt, ""},
+		{loanWalletID, txn.Amt, 0, ""},
+	}
+	if programType == "ap" {
+		supplierLiabilityWalletID, err := getWalletIDonly(stub, "businesscc", borrowerID, "liability")
+		if err != nil {
+			return shim.Error("Supplier Liability Wallet(Disbursement):" + err.Error())
+		}
+		anchorLiabilityWalletID, err := getWalletIDonly(stub, "businesscc", ins.BuyBusinsessID, "liability")
+		if err != nil {
+			return shim.Error("Anchor Liability Wallet(Disbursement):" + err.Error())
+		}
+		legs = append(legs,
+			journalLeg{supplierLiabilityWalletID, txn.Amt, 0, ""},
+			journalLeg{anchorLiabilityWalletID, 0, txn.Amt, ""},
+		)
+	}
+	err = postJournal(stub, txn, legs)
+	if err != nil {
+		return shim.Error("Wallets(Disbursement):" + err.Error())
 	}
-	fmt.Println(string(response.GetPayload()))
 
 	//####################################################################################################################
-	//Calling for updating Bank Asset_Wallet
+	//Calling for Loan Balance Update
 	//####################################################################################################################
-
-	cAmtString = args[5]
-	dAmtString = "0"
-
-	walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[6], "asset", "bankcc", cAmtString, dAmtString)
+	loanBal := updateLoanBalRequest{LoanBalID: "1loanbal", LoanID: txn.LoanID, TxnID: txn.TxnID, TxnDate: txn.TxnDate, TxnType: txn.TxnType, CAmt: 0, DAmt: txn.Amt, Mode: "disb"}
+	loanBalBytes, err := json.Marshal(loanBal)
 	if err != nil {
-		return shim.Error("Bank Asset Wallet(Disbursement)" + err.Error())
+		return shim.Error(err.Error())
 	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"4", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
+	chaincodeArgs := toChaincodeArgs("updateLoanBal", string(loanBalBytes))
+	//sending to loanBalUp chaincode not loanBalance Chaincode
+	response := stub.InvokeChaincode("loanbalcc", chaincodeArgs, "myc")
 	if response.Status != shim.OK {
 		return shim.Error(response.Message)
 	}
-	fmt.Println(string(response.GetPayload()))
-	//####################################################################################################################
 
 	//####################################################################################################################
-	//Calling for Loan Balance Update
+	//Calling for Instrument Status Update
 	//####################################################################################################################
-	CAmt := "0"
-	DAmt := args[5]
-	argStrings := []string{"1loanbal", args[3], args[0], args[2], args[1], CAmt, DAmt, "disb"} // 6 variables for updateLoanBalance
-	// args[5] -> DAmt for loanBalance
-	argStr := strings.Join(argStrings, ",")
-	chaincodeArgs = toChaincodeArgs("updateLoanBal", argStr)
-	//sending to loanBalUp chaincode not loanBalance Chaincode
-	response = stub.InvokeChaincode("loanbalcc", chaincodeArgs, "myc")
+	// The instrument is disbursed once nothing of the loan is left to
+	// disburse, the loan is not read back as our own writes are not seen
+	// within the transaction
+	disbursement := updateLoanBalResult{}
+	err = json.Unmarshal(response.Payload, &disbursement)
+	if err != nil {
+		return shim.Error("Invalid response from updateLoanBal (disb): " + err.Error())
+	}
+	insStatus := "part disbursed"
+	if disbursement.LoanStatus == "disbursed" {
+		insStatus = "disbursed"
+	}
+	chaincodeArgs = toChaincodeArgs("updateInstrumentStatus", loan.InstNum, insStatus)
+	response = stub.InvokeChaincode("instrumentcc", chaincodeArgs, "myc")
 	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+		return shim.Error("Instrument " + txn.InsID + " (Disbursement):" + response.Message)
 	}
-	//walletID := string(response.GetPayload())
 
 	return shim.Success(nil)
 }
@@ -182,56 +262,84 @@ func toChaincodeArgs(args ...string) [][]byte {
 	return bargs
 }
 
-func getWalletInfo(stub shim.ChaincodeStubInterface, participantID string, walletType string, ccName string, cAmtStr string, dAmtStr string) (string, string, string, error) {
+// decodeRequest parses a JSON request from another chaincode, unknown fields are rejected
+func decodeRequest(reqStr string, req interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(reqStr))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(req)
+}
+
+func getWalletIDonly(stub shim.ChaincodeStubInterface, ccName string, id string, walletType string) (string, error) {
 
 	// STEP-1
 	// using FromID, get a walletID from bank structure
-	// bankID = bankID
 
-	chaincodeArgs := toChaincodeArgs("getWalletID", participantID, walletType)
+	chaincodeArgs := toChaincodeArgs("getWalletID", id, walletType)
 	response := stub.InvokeChaincode(ccName, chaincodeArgs, "myc")
 	if response.Status != shim.OK {
-		return "", "", "", errors.New(response.Message)
+		return "", errors.New(response.Message)
 	}
 	walletID := string(response.GetPayload())
+	return walletID, nil
+}
 
-	// STEP-2
-	// getting Balance from walletID
-	// walletFcn := "getWallet"
-	walletArgs := toChaincodeArgs("getWallet", walletID)
-	walletResponse := stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return "", "", "", errors.New(walletResponse.Message)
+// getInstrumentProgram returns the loan, the parties of its instrument and
+// the type of its program (ar, ap or df). The instrument is found through the
+// loan since reference numbers are only unique per seller.
+func getInstrumentProgram(stub shim.ChaincodeStubInterface, txn txnRequest) (loanBalStatus, instrumentParties, string, error) {
+	ins := instrumentParties{}
+	loan := loanBalStatus{}
+	chaincodeArgs := toChaincodeArgs("getLoanBalStatus", txn.LoanID)
+	response := stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return loan, ins, "", errors.New(response.Message)
 	}
-	openBalString := string(walletResponse.Payload)
-
-	openBal, err := strconv.ParseInt(openBalString, 10, 64)
+	err := json.Unmarshal(response.Payload, &loan)
 	if err != nil {
-		return "", "", "", errors.New("Error in converting the openBalance")
+		return loan, ins, "", errors.New("Unable to parse the loan " + txn.LoanID + ": " + err.Error())
 	}
-	cAmt, err := strconv.ParseInt(cAmtStr, 10, 64)
-	if err != nil {
-		return "", "", "", errors.New("Error in converting the cAmt")
+
+	chaincodeArgs = toChaincodeArgs("getInstrument", loan.InstNum)
+	response = stub.InvokeChaincode("instrumentcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return loan, ins, "", errors.New(response.Message)
 	}
-	dAmt, err := strconv.ParseInt(dAmtStr, 10, 64)
+	err = json.Unmarshal(response.Payload, &ins)
 	if err != nil {
-		return "", "", "", errors.New("Error in converting the dAmt")
+		return loan, ins, "", errors.New("Unable to parse the instrument " + loan.InstNum + ": " + err.Error())
+	}
+	if ins.InstrumentRefNo != txn.InsID {
+		return loan, ins, "", errors.New("Loan " + txn.LoanID + " is on instrument " + ins.InstrumentRefNo + ", given:" + txn.InsID)
 	}
 
-	txnBal := openBal - dAmt + cAmt
-	txnBalString := strconv.FormatInt(txnBal, 10)
-
-	// STEP-3
-	// update wallet of ID walletID here, and write it to the wallet_ledger
-	// walletFcn := "updateWallet"
+	chaincodeArgs = toChaincodeArgs("getProgram", ins.ProgramID)
+	response = stub.InvokeChaincode("programcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return loan, ins, "", errors.New(response.Message)
+	}
+	program := programType{}
+	err = json.Unmarshal(response.Payload, &program)
+	if err != nil {
+		return loan, ins, "", errors.New("Unable to parse the program " + ins.ProgramID + ": " + err.Error())
+	}
+	return loan, ins, program.ProgramType, nil
+}
 
-	walletArgs = toChaincodeArgs("updateWallet", walletID, txnBalString)
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return "", "", "", errors.New(walletResponse.Message)
+// postJournal posts the legs of txn as one balanced journal in walletcc,
+// which also writes the TxnBalance rows of every leg
+func postJournal(stub shim.ChaincodeStubInterface, txn txnRequest, legs []journalLeg) error {
+	journal := journalRequest{txn.TxnID, txn.TxnDate, txn.LoanID, txn.InsID, txn.TxnType, txn.By, legs}
+	journalBytes, err := json.Marshal(journal)
+	if err != nil {
+		return err
 	}
 
-	return walletID, openBalString, txnBalString, nil
+	chaincodeArgs := toChaincodeArgs("postJournal", string(journalBytes))
+	response := stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
 }
 
 func main() {
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// fakeChaincode stands in for a peer chaincode, it answers each function
+// from responses and records the calls made to it. getWalletID answers
+// ownerID_role for any owner.
+type fakeChaincode struct {
+	responses map[string]pb.Response
+	calls     [][]string
+}
+
+func (f *fakeChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (f *fakeChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	f.calls = append(f.calls, append([]string{function}, args...))
+	if function == "getWalletID" {
+		return shim.Success([]byte(args[0] + "_" + args[1]))
+	}
+	response, ok := f.responses[function]
+	if !ok {
+		return shim.Error("No function named " + function)
+	}
+	return response
+}
+
+func (f *fakeChaincode) callsTo(function string) [][]string {
+	calls := [][]string{}
+	for _, call := range f.calls {
+		if call[0] == function {
+			calls = append(calls, call[1:])
+		}
+	}
+	return calls
+}
+
+func jsonSuccess(t *testing.T, v interface{}) pb.Response {
+	vBytes, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shim.Success(vBytes)
+}
+
+// newDisbStub returns a disbursement chaincode with its peer chaincodes
+// faked, the loan L1 of bank1 is on instrument INS1 (REF1) sold by the
+// anchor to the dealer under a program of progType
+func newDisbStub(t *testing.T, progType string, loanStatus string) (*shim.MockStub, map[string]*fakeChaincode) {
+	stub := shim.NewMockStub("disbursementcc", new(chainCode))
+	fakes := map[string]*fakeChaincode{
+		"loancc": {responses: map[string]pb.Response{
+			"getLoanBalStatus": jsonSuccess(t, loanBalStatus{LoanBalance: 1000, LoanStatus: "sanctioned", SanctionAmt: 1000, InstNum: "INS1", BankID: "bank1"}),
+		}},
+		"instrumentcc": {responses: map[string]pb.Response{
+			"getInstrument":          jsonSuccess(t, instrumentParties{"REF1", "anchor", "dealer", "P1"}),
+			"updateInstrumentStatus": shim.Success(nil),
+		}},
+		"programcc": {responses: map[string]pb.Response{
+			"getProgram": jsonSuccess(t, programType{progType}),
+		}},
+		"loanbalcc": {responses: map[string]pb.Response{
+			"updateLoanBal": jsonSuccess(t, updateLoanBalResult{LoanStatus: loanStatus}),
+		}},
+		"walletcc":   {responses: map[string]pb.Response{"postJournal": shim.Success(nil)}},
+		"bankcc":     {},
+		"businesscc": {},
+	}
+	for ccName, fake := range fakes {
+		stub.MockPeerChaincode(ccName+"/myc", shim.NewMockStub(ccName, fake))
+	}
+	return stub, fakes
+}
+
+func invokeDisb(t *testing.T, stub *shim.MockStub, txn txnRequest) pb.Response {
+	txnBytes, err := json.Marshal(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stub.MockInvoke("tx1", [][]byte{[]byte("newDisbInfo"), txnBytes})
+}
+
+func TestDFDisbursementPaysAnchorAndLendsToDealer(t *testing.T) {
+	stub, fakes := newDisbStub(t, "df", "part disbursed")
+	txn := txnRequest{TxnID: "T1", TxnType: "disbursement", TxnDate: "01/02/2024", LoanID: "L1", InsID: "REF1", Amt: 600, FromID: "bank1", ToID: "anchor"}
+
+	response := invokeDisb(t, stub, txn)
+	if response.Status != shim.OK {
+		t.Fatalf("disbursement failed: %s", response.Message)
+	}
+
+	journals := fakes["walletcc"].callsTo("postJournal")
+	if len(journals) != 1 {
+		t.Fatalf("want 1 journal, got %d", len(journals))
+	}
+	journal := journalRequest{}
+	err := json.Unmarshal([]byte(journals[0][0]), &journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []journalLeg{
+		{"bank1_main", 600, 0, "L1"},
+		{"anchor_main", 0, 600, ""},
+		{"bank1_asset", 0, 600, ""},
+		{"dealer_loan", 600, 0, ""},
+	}
+	if len(journal.Legs) != len(want) {
+		t.Fatalf("want legs %v, got %v", want, journal.Legs)
+	}
+	for i := range want {
+		if journal.Legs[i] != want[i] {
+			t.Errorf("leg %d: want %v, got %v", i+1, want[i], journal.Legs[i])
+		}
+	}
+
+	statuses := fakes["instrumentcc"].callsTo("updateInstrumentStatus")
+	if len(statuses) != 1 || statuses[0][0] != "INS1" || statuses[0][1] != "part disbursed" {
+		t.Errorf("want INS1 part disbursed, got %v", statuses)
+	}
+}
+
+func TestDFDisbursementRejectsPayeeOtherThanAnchor(t *testing.T) {
+	stub, fakes := newDisbStub(t, "df", "part disbursed")
+	txn := txnRequest{TxnID: "T1", TxnType: "disbursement", TxnDate: "01/02/2024", LoanID: "L1", InsID: "REF1", Amt: 600, FromID: "bank1", ToID: "dealer"}
+
+	response := invokeDisb(t, stub, txn)
+	if response.Status == shim.OK || !strings.Contains(response.Message, "anchor") {
+		t.Fatalf("want the dealer finance payee rejected, got %d %s", response.Status, response.Message)
+	}
+	if len(fakes["walletcc"].callsTo("postJournal")) != 0 {
+		t.Error("no journal should be posted for a rejected disbursement")
+	}
+}
+
+func TestDisbursementRejectsOtherBank(t *testing.T) {
+	stub, fakes := newDisbStub(t, "df", "part disbursed")
+	txn := txnRequest{TxnID: "T1", TxnType: "disbursement", TxnDate: "01/02/2024", LoanID: "L1", InsID: "REF1", Amt: 600, FromID: "bank2", ToID: "anchor"}
+
+	response := invokeDisb(t, stub, txn)
+	if response.Status == shim.OK || !strings.Contains(response.Message, "bank1") {
+		t.Fatalf("want a bank other than the lender rejected, got %d %s", response.Status, response.Message)
+	}
+	if len(fakes["walletcc"].callsTo("postJournal")) != 0 {
+		t.Error("no journal should be posted for a rejected disbursement")
+	}
+}
+
+func TestARDisbursementLendsToPayee(t *testing.T) {
+	stub, fakes := newDisbStub(t, "ar", "disbursed")
+	txn := txnRequest{TxnID: "T1", TxnType: "disbursement", TxnDate: "01/02/2024", LoanID: "L1", InsID: "REF1", Amt: 1000, FromID: "bank1", ToID: "anchor"}
+
+	response := invokeDisb(t, stub, txn)
+	if response.Status != shim.OK {
+		t.Fatalf("disbursement failed: %s", response.Message)
+	}
+	journal := journalRequest{}
+	err := json.Unmarshal([]byte(fakes["walletcc"].callsTo("postJournal")[0][0]), &journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if journal.Legs[3] != (journalLeg{"anchor_loan", 1000, 0, ""}) {
+		t.Errorf("want the seller's loan wallet debited, got %v", journal.Legs[3])
+	}
+	statuses := fakes["instrumentcc"].callsTo("updateInstrumentStatus")
+	if len(statuses) != 1 || statuses[0][1] != "disbursed" {
+		t.Errorf("want INS1 disbursed, got %v", statuses)
+	}
+}
+
+func TestAPDisbursementRaisesSupplierLiability(t *testing.T) {
+	// In the stub the AP program's supplier (seller) is "anchor" and its
+	// anchor (buyer) is "dealer"
+	stub, fakes := newDisbStub(t, "ap", "disbursed")
+	txn := txnRequest{TxnID: "T1", TxnType: "disbursement", TxnDate: "01/02/2024", LoanID: "L1", InsID: "REF1", Amt: 1000, FromID: "bank1", ToID: "anchor"}
+
+	response := invokeDisb(t, stub, txn)
+	if response.Status != shim.OK {
+		t.Fatalf("disbursement failed: %s", response.Message)
+	}
+	journal := journalRequest{}
+	err := json.Unmarshal([]byte(fakes["walletcc"].callsTo("postJournal")[0][0]), &journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []journalLeg{
+		{"bank1_main", 1000, 0, "L1"},
+		{"anchor_main", 0, 1000, ""},
+		{"bank1_asset", 0, 1000, ""},
+		{"anchor_loan", 1000, 0, ""},
+		{"anchor_liability", 1000, 0, ""},
+		{"dealer_liability", 0, 1000, ""},
+	}
+	if len(journal.Legs) != len(want) {
+		t.Fatalf("want legs %v, got %v", want, journal.Legs)
+	}
+	for i := range want {
+		if journal.Legs[i] != want[i] {
+			t.Errorf("leg %d: want %v, got %v", i+1, want[i], journal.Legs[i])
+		}
+	}
+}
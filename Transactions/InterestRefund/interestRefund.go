@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -14,6 +15,53 @@ import (
 type chainCode struct {
 }
 
+// txnRequest is accepted by newDisbInfo as JSON
+type txnRequest struct {
+	TxnID   string
+	TxnType string
+	TxnDate string // dd/mm/yyyy
+	LoanID  string
+	InsID   string
+	Amt     int64
+	FromID  string // Bank
+	ToID    string // Business
+	By      string
+	PprID   string
+}
+
+// txnBalRequest is sent to creditWallet and debitWallet in walletcc as JSON,
+// walletcc fills in the wallet, amounts and balances before writing it into
+// txnbalcc
+type txnBalRequest struct {
+	TxnBalID   string
+	TxnID      string
+	TxnDate    string // dd/mm/yyyy
+	LoanID     string
+	InsID      string
+	WalletID   string
+	OpeningBal int64
+	TxnType    string
+	Amt        int64
+	CAmt       int64
+	DAmt       int64
+	TxnBal     int64
+	By         string
+}
+
+// updateLoanBalRequest is sent to updateLoanBal in loanbalcc as JSON
+type updateLoanBalRequest struct {
+	LoanBalID string
+	LoanID    string
+	TxnID     string
+	TxnDate   string // dd/mm/yyyy
+	TxnType   string
+	CAmt      int64
+	DAmt      int64
+	Amt       int64
+	InsID     string
+	Mode      string // disb or inst
+}
+
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
@@ -29,25 +77,25 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 
 func newDisbInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) == 1 {
-		args = strings.Split(args[0], ",")
-	}
-	if len(args) != 10 {
+	/*
+	 *args[0] -> txnRequest as JSON
+	 */
+	if len(args) != 1 {
 		xLenStr := strconv.Itoa(len(args))
-		return shim.Error("Invalid number of arguments in newDisbInfo(disbursement) (required:10) given:" + xLenStr)
+		return shim.Error("Invalid number of arguments in newDisbInfo(disbursement) (required:1) given:" + xLenStr)
 	}
 
-	/*
-	 *TxnType string    //args[1]
-	 *TxnDate time.Time //args[2]
-	 *LoanID  string    //args[3]
-	 *InsID   string    //args[4]
-	 *Amt     int64     //args[5]
-	 *FromID  string    //args[6]
-	 *ToID    string    //args[7]
-	 *By      string    //args[8]
-	 *PprID   string    //args[9]
-	 */
+	txn := txnRequest{}
+	err := decodeRequest(args[0], &txn)
+	if err != nil {
+		return shim.Error("Invalid request in newDisbInfo(disbursement): " + err.Error())
+	}
+	if txn.TxnID == "" || txn.TxnDate == "" || txn.LoanID == "" || txn.FromID == "" || txn.ToID == "" {
+		return shim.Error("TxnID, TxnDate, LoanID, FromID and ToID are required in newDisbInfo(disbursement)")
+	}
+	if txn.Amt <= 0 {
+		return shim.Error("Amt should be greater than zero in newDisbInfo(disbursement)")
+	}
 
 	///////////////////////////////////////////////////////////////////////////////////////////////////
 	// 				UPDATING WALLETS																///
@@ -67,85 +115,46 @@ func newDisbInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	//Calling for updating Bank Main_Wallet
 	//####################################################################################################################
 
-	cAmtString := "0"
-	dAmtString := args[5]
-
-	walletID, openBalString, txnBalString, err := getWalletInfo(stub, args[6], "main", "bankcc", cAmtString, dAmtString)
+	// walletcc writes the txn_balance_object to the Txn_Bal_Ledger
+	err = updateWallet(stub, txn.FromID, "main", "bankcc", 0, txn.Amt, newTxnBal(txn, "_1"))
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList := []string{"1", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr := strings.Join(argsList, ",")
-	chaincodeArgs := util.ToChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response := stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
-	}
-	fmt.Println(string(response.GetPayload()))
 	//successfully updated Bank's main wallet and written the txn thing to the ledger
 
 	//#####################################################################################################################
 	//Calling for updating Business Main_Wallet
 	//####################################################################################################################
 
-	cAmtString = args[5]
-	dAmtString = "0"
-
-	walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[7], "main", "businesscc", cAmtString, dAmtString)
+	// walletcc writes the txn_balance_object to the Txn_Bal_Ledger
+	err = updateWallet(stub, txn.ToID, "main", "businesscc", txn.Amt, 0, newTxnBal(txn, "_2"))
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"2", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = util.ToChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
-	}
-	fmt.Println(string(response.GetPayload()))
 	//successfully updated Bank's main wallet and written the txn thing to the ledger
 
 	//####################################################################################################################
 	//Calling for updating Bank Refund_Wallet
 	//####################################################################################################################
 
-	cAmtString = "0"
-	dAmtString = args[5]
-
-	walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[6], "refund", "bankcc", cAmtString, dAmtString)
+	// walletcc writes the txn_balance_object to the Txn_Bal_Ledger
+	err = updateWallet(stub, txn.FromID, "refund", "bankcc", 0, txn.Amt, newTxnBal(txn, "_3"))
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"5", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = util.ToChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
-	}
-	fmt.Println(string(response.GetPayload()))
 	//####################################################################################################################
 
 	//####################################################################################################################
 	//Calling for Loan Balance Update
 	//####################################################################################################################
-	CAmt := "0"
-	DAmt := args[5]
-	argStrings := []string{"1loanBal", args[3], args[0], args[2], args[1], CAmt, DAmt} // 6 variables for updateLoanBalance
-	// args[5] -> DAmt for loanBalance
-	argStr := strings.Join(argStrings, ",")
-	chaincodeArgs = util.ToChaincodeArgs("updateLoanBal", argStr)
+	loanBal := updateLoanBalRequest{LoanBalID: "1loanBal", LoanID: txn.LoanID, TxnID: txn.TxnID, TxnDate: txn.TxnDate, TxnType: txn.TxnType, CAmt: 0, DAmt: txn.Amt, Mode: "disb"}
+	loanBalBytes, err := json.Marshal(loanBal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	chaincodeArgs := util.ToChaincodeArgs("updateLoanBal", string(loanBalBytes))
 	//sending to loanBalUp chaincode not loanBalance Chaincode
-	response = stub.InvokeChaincode("loanbalcc", chaincodeArgs, "myc")
+	response := stub.InvokeChaincode("loanbalcc", chaincodeArgs, "myc")
 	if response.Status != shim.OK {
 		return shim.Error(response.Message)
 	}
@@ -155,79 +164,75 @@ func newDisbInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	//Calling for updating Bank Asset_Wallet
 	//####################################################################################################################
 
-	cAmtString = "0"
-	dAmtString = args[5]
-
-	walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[6], "asset", "bankcc", cAmtString, dAmtString)
+	// walletcc writes the txn_balance_object to the Txn_Bal_Ledger
+	err = updateWallet(stub, txn.FromID, "asset", "bankcc", 0, txn.Amt, newTxnBal(txn, "_4"))
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"4", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = util.ToChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
-	}
-	fmt.Println(string(response.GetPayload()))
 	//successfully updated Bank's main wallet and written the txn thing to the ledger
 
 	return shim.Success(nil)
 }
 
-func getWalletInfo(stub shim.ChaincodeStubInterface, participantID string, walletType string, ccName string, cAmtStr string, dAmtStr string) (string, string, string, error) {
+// decodeRequest parses a JSON request from another chaincode, unknown fields are rejected
+func decodeRequest(reqStr string, req interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(reqStr))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(req)
+}
 
-	// STEP-1
-	// using FromID, get a walletID from bank structure
-	// bankID = bankID
+func updateWallet(stub shim.ChaincodeStubInterface, participantID string, walletType string, ccName string, cAmt int64, dAmt int64, txnBal txnBalRequest) error {
 
-	chaincodeArgs := util.ToChaincodeArgs("getWalletID", participantID, walletType)
-	response := stub.InvokeChaincode(ccName, chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return "", "", "", errors.New(response.Message)
+	//STEP-1
+	// Getting wallet id from the chaincode
+	walletID, err := getWalletIDonly(stub, ccName, participantID, walletType)
+	if err != nil {
+		return err
 	}
-	walletID := string(response.GetPayload())
 
 	// STEP-2
-	// getting Balance from walletID
-	// walletFcn := "getWallet"
-	walletArgs := util.ToChaincodeArgs("getWallet", walletID)
-	walletResponse := stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return "", "", "", errors.New(walletResponse.Message)
+	// crediting or debiting the wallet of ID walletID, walletcc writes the
+	// Transaction Balance row from txnBal
+	if cAmt != 0 && dAmt != 0 {
+		return errors.New("Either cAmt or dAmt should be given for wallet " + walletID)
 	}
-	openBalString := string(walletResponse.Payload)
 
-	openBal, err := strconv.ParseInt(openBalString, 10, 64)
-	if err != nil {
-		return "", "", "", errors.New("Error in converting the openBalance")
+	walletFcn := "creditWallet"
+	amt := cAmt
+	if dAmt != 0 {
+		walletFcn = "debitWallet"
+		amt = dAmt
 	}
-	cAmt, err := strconv.ParseInt(cAmtStr, 10, 64)
+	txnBalBytes, err := json.Marshal(txnBal)
 	if err != nil {
-		return "", "", "", errors.New("Error in converting the cAmt")
+		return err
 	}
-	dAmt, err := strconv.ParseInt(dAmtStr, 10, 64)
-	if err != nil {
-		return "", "", "", errors.New("Error in converting the dAmt")
+	walletArgs := util.ToChaincodeArgs(walletFcn, walletID, strconv.FormatInt(amt, 10), string(txnBalBytes))
+	walletResponse := stub.InvokeChaincode("walletcc", walletArgs, "myc")
+	if walletResponse.Status != shim.OK {
+		return errors.New(walletResponse.Message)
 	}
+	return nil
+}
 
-	txnBal := openBal - dAmt + cAmt
-	txnBalString := strconv.FormatInt(txnBal, 10)
+// newTxnBal gives the transaction details of a Transaction Balance row of
+// txn, walletcc fills in the rest
+func newTxnBal(txn txnRequest, suffix string) txnBalRequest {
+	return txnBalRequest{TxnBalID: txn.TxnID + suffix, TxnID: txn.TxnID, TxnDate: txn.TxnDate, LoanID: txn.LoanID, InsID: txn.InsID, TxnType: txn.TxnType, Amt: txn.Amt, By: txn.By}
+}
 
-	// STEP-3
-	// update wallet of ID walletID here, and write it to the wallet_ledger
-	// walletFcn := "updateWallet"
+func getWalletIDonly(stub shim.ChaincodeStubInterface, ccName string, id string, walletType string) (string, error) {
 
-	walletArgs = util.ToChaincodeArgs("updateWallet", walletID, txnBalString)
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return "", "", "", errors.New(walletResponse.Message)
-	}
+	// STEP-1
+	// using FromID, get a walletID from bank structure
 
-	return walletID, openBalString, txnBalString, nil
+	chaincodeArgs := util.ToChaincodeArgs("getWalletID", id, walletType)
+	response := stub.InvokeChaincode(ccName, chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return "", errors.New(response.Message)
+	}
+	walletID := string(response.GetPayload())
+	return walletID, nil
 }
 
 func main() {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -12,6 +13,37 @@ import (
 
 type chainCode struct{}
 
+// loanBalStatus is returned by getLoanBalStatus in loancc
+type loanBalStatus struct {
+	LoanBalance int64
+	LoanStatus  string
+	SanctionAmt int64
+}
+
+// updateLoanBalRequest is the JSON request updateLoanBal accepts from disbursementcc
+type updateLoanBalRequest struct {
+	LoanBalID string
+	LoanID    string
+	TxnID     string
+	TxnDate   string // dd/mm/yyyy
+	TxnType   string
+	CAmt      int64
+	DAmt      int64
+	Amt       int64
+	InsID     string
+	Mode      string // disb
+}
+
+// loanTxnRequest is sent to updateLoanInfo in loancc as JSON
+type loanTxnRequest struct {
+	TxnID        string
+	TxnDate      string // dd/mm/yyyy
+	Mode         string
+	Amt          int64
+	PrincipalAmt int64
+	LoanStatus   string
+}
+
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
@@ -26,62 +58,66 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 
 func updateLoanBal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	/*
-			// From Disbursement
-		*LoanID  -> args[0]
-		*TxnID   -> args[1]
-		*TxnDate -> args[2]
-		*TxnType -> args[3]
-		*DAmt    -> args[4]
-
-
-		*OpenBal -> LoanBalance from Loan structure
-		*CAmt
-
-		*LoanBal -> OpenBal-DAmt+Camt
-		*LoanStatus -> depends
-	*/
+	*args[0] -> updateLoanBalRequest as JSON, from Disbursement
+	*
+	*OpenBal -> LoanBalance from Loan structure
+	*LoanBal -> OpenBal-DAmt+Camt
+	*LoanStatus -> depends
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in updateLoanBal (required:1) given:" + xLenStr)
+	}
 
-	if len(args) == 1 {
-		args = strings.Split(args[0], ",")
+	req := updateLoanBalRequest{}
+	err := decodeRequest(args[0], &req)
+	if err != nil {
+		return shim.Error("Invalid request in updateLoanBal: " + err.Error())
 	}
-	if len(args) != 5 {
-		return shim.Error("Required 5 arguments in updateLoanBal from Disbursement")
+	if req.LoanID == "" || req.TxnID == "" || req.TxnDate == "" {
+		return shim.Error("LoanID, TxnID and TxnDate are required in updateLoanBal")
+	}
+	if req.DAmt < 0 {
+		return shim.Error("DAmt cannot be negative in updateLoanBal")
 	}
 
 	//argsList := []string{"1", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
 	//argsListStr := strings.Join(argsList, ",")
-	chaincodeArgs := util.ToChaincodeArgs("getLoanInfo")
+	chaincodeArgs := util.ToChaincodeArgs("getLoanBalStatus", req.LoanID)
 	fmt.Println("calling the other chaincode")
 	response := stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
 	if response.Status != shim.OK {
 		return shim.Error(response.Message)
 	}
-	// spliting the arguments got from loan as response
-	loanArgs := strings.Split(string(response.Payload), ",")
-	openBal, err := strconv.ParseInt(loanArgs[0], 10, 64)
+	loan := loanBalStatus{}
+	err = json.Unmarshal(response.Payload, &loan)
 	if err != nil {
-		return shim.Error("Error in parsing the openbalance in LoanBalance: " + err.Error())
+		return shim.Error("Unable to parse the loan balance in LoanBalance: " + err.Error())
 	}
+	openBal := loan.LoanBalance
 	CAmt := int64(0)
-	DAmt, err := strconv.ParseInt(args[4], 10, 64)
-	if err != nil {
-		return shim.Error("Error in parsing the DAmt in LoanBalance: " + err.Error())
-	}
+	DAmt := req.DAmt
 
 	var status string
-	status = loanArgs[1] // status of the current loan
+	status = loan.LoanStatus // status of the current loan
 	loanBal := openBal - DAmt + CAmt
-	loanBalString := strconv.FormatInt(loanBal, 64)
-	if status == "open" || status == "partly disbursed" {
+	if loanBal < 0 {
+		return shim.Error("Disbursement is more than the loan balance in updateLoanBal")
+	}
+	if status == "sanctioned" || status == "part disbursed" || status == "partly disbursed" {
 
-		if openBal-loanBal == 0 {
+		if loanBal == 0 {
 			status = "disbursed"
 		} else {
-			status = "partly disbursed"
+			status = "part disbursed"
 		}
 	}
 	fmt.Printf("Status:%s\n", status)
-	chaincodeArgs = util.ToChaincodeArgs("updateLoanInfo", args[0], status, loanBalString)
+	loanReqBytes, err := json.Marshal(loanTxnRequest{TxnID: req.TxnID, TxnDate: req.TxnDate, Mode: "disb", Amt: DAmt - CAmt, LoanStatus: status})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	chaincodeArgs = util.ToChaincodeArgs("updateLoanInfo", req.LoanID, string(loanReqBytes))
 	fmt.Println("calling the other chaincode")
 	response = stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
 	if response.Status != shim.OK {
@@ -90,6 +126,16 @@ func updateLoanBal(stub shim.ChaincodeStubInterface, args []string) pb.Response
 	return shim.Success(nil)
 }
 
-func main() {
+// decodeRequest parses a JSON request from another chaincode, unknown fields are rejected
+func decodeRequest(reqStr string, req interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(reqStr))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(req)
+}
 
+func main() {
+	err := shim.Start(new(chainCode))
+	if err != nil {
+		fmt.Printf("Error starting LoanBalUp chaincode: %s\n", err)
+	}
 }
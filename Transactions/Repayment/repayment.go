@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -13,6 +15,84 @@ import (
 type chainCode struct {
 }
 
+// txnRequest is sent by txncc to newRepayInfo as JSON
+type txnRequest struct {
+	TxnID   string
+	TxnType string
+	TxnDate string // dd/mm/yyyy
+	LoanID  string
+	InsID   string
+	Amt     int64
+	FromID  string // Business
+	ToID    string // Bank
+	By      string
+	PprID   string
+}
+
+// updateLoanBalRequest is sent to updateLoanBal in loanbalcc as JSON
+type updateLoanBalRequest struct {
+	LoanBalID      string
+	LoanID         string
+	TxnID          string
+	TxnDate        string // dd/mm/yyyy
+	TxnType        string
+	CAmt           int64
+	DAmt           int64
+	Amt            int64
+	InsID          string
+	Mode           string // disb or inst
+	PaidBy         string // business that repaid
+	SettlementMode string // direct, or anchor for an AP settlement
+}
+
+// journalRequest is sent to postJournal in walletcc as JSON
+type journalRequest struct {
+	TxnID   string
+	TxnDate string // dd/mm/yyyy
+	LoanID  string
+	InsID   string
+	TxnType string
+	By      string
+	Legs    []journalLeg
+}
+
+// instrumentParties is the part of getInstrument in instrumentcc used here
+type instrumentParties struct {
+	InstrumentRefNo string
+	SellBusinessID  string
+	BuyBusinsessID  string
+	ProgramID       string
+	InsDueDate      time.Time
+}
+
+// updateLoanBalResult is returned by updateLoanBal in loanbalcc
+type updateLoanBalResult struct {
+	LoanStatus   string
+	PrincipalAmt int64
+	RefundAmt    int64
+	CollectedAmt int64
+}
+
+// loanBalStatus is returned by getLoanBalStatus in loancc
+type loanBalStatus struct {
+	LoanBalance int64
+	LoanStatus  string
+	SanctionAmt int64
+	InstNum     string
+}
+
+// programType is the part of getProgram in programcc used here
+type programType struct {
+	ProgramType string
+}
+
+// journalLeg is one leg of a postJournal call in walletcc
+type journalLeg struct {
+	WalletID string
+	DAmt     int64
+	CAmt     int64
+}
+
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
@@ -28,304 +108,178 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 
 func newRepayInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) == 1 {
-		args = strings.Split(args[0], ",")
-	}
-	if len(args) != 10 {
+	/*
+	 *args[0] -> txnRequest as JSON, sent by txncc
+	 */
+	if len(args) != 1 {
 		xLenStr := strconv.Itoa(len(args))
-		return shim.Error("Invalid number of arguments in newRepayInfo(repayment) (required:10) given:" + xLenStr)
+		return shim.Error("Invalid number of arguments in newRepayInfo(repayment) (required:1) given:" + xLenStr)
 	}
 
-	/*
-	 *TxnType string    //args[1]
-	 *TxnDate time.Time //args[2]
-	 *LoanID  string    //args[3]
-	 *InsID   string    //args[4]
-	 *Amt     int64     //args[5]
-	 *FromID  string    //args[6]  Business
-	 *ToID    string    //args[7]  Bank
-	 *By      string    //args[8]
-	 *PprID   string    //args[9]
-	 */
+	txn := txnRequest{}
+	err := decodeRequest(args[0], &txn)
+	if err != nil {
+		return shim.Error("Invalid request in newRepayInfo(repayment): " + err.Error())
+	}
+	if txn.TxnID == "" || txn.TxnDate == "" || txn.LoanID == "" || txn.InsID == "" || txn.FromID == "" || txn.ToID == "" {
+		return shim.Error("TxnID, TxnDate, LoanID, InsID, FromID and ToID are required in newRepayInfo(repayment)")
+	}
+	if txn.Amt <= 0 {
+		return shim.Error("Amt should be greater than zero in newRepayInfo(repayment)")
+	}
 
 	///////////////////////////////////////////////////////////////////////////////////////////////////
 	// 				UPDATING WALLETS																///
 	///////////////////////////////////////////////////////////////////////////////////////////////////
-	// The transaction object has been created and written into the ledger
-	// The JSON file is 'transaction'function
-	// Now to create a TXN_Bal_Update obj for 4 times
-	// Calling TXN_Balance CC based on TXN_Type {ex: Disbursement}
-	/*
-	 *	bank main wallet reduced
-	 * 	bank asset wallet incresed
-	 *	business main wallet increased
-	 *	business loan wallet increased
-	 */
-
-	//#####################################################################################################################
-	//Calling for updating Business Main_Wallet
-	//####################################################################################################################
-
-	cAmtString := "0"
-	dAmtString := args[5]
-
-	walletID, openBalString, txnBalString, err := getWalletInfo(stub, args[6], "main", "businesscc", cAmtString, dAmtString)
+	// In a dealer finance (df) program the dealer (buyer) is the borrower and
+	// repays, otherwise the loan is on the seller of the instrument. In a
+	// reverse factoring (ap) program the supplier was paid early and the
+	// anchor (buyer) settles the bank on the due date of the instrument.
+	instID, ins, programType, err := getInstrumentProgram(stub, txn)
 	if err != nil {
-		return shim.Error(err.Error())
+		return shim.Error("Instrument " + txn.InsID + " (repayment):" + err.Error())
 	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList := []string{"5", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr := strings.Join(argsList, ",")
-	chaincodeArgs := toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode business main")
-	response := stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+	borrowerID := ins.SellBusinessID
+	settlementMode := "direct"
+	switch programType {
+	case "df":
+		if txn.FromID != ins.BuyBusinsessID {
+			return shim.Error("Dealer finance repayment should be taken from the dealer " + ins.BuyBusinsessID + ", given:" + txn.FromID)
+		}
+		borrowerID = ins.BuyBusinsessID
+	case "ap":
+		if txn.FromID != ins.BuyBusinsessID {
+			return shim.Error("AP settlement should be paid by the anchor " + ins.BuyBusinsessID + ", given:" + txn.FromID)
+		}
+		txnDate, err := time.Parse("02/01/2006", txn.TxnDate)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if txnDate.Before(ins.InsDueDate) {
+			return shim.Error("AP settlement of instrument " + txn.InsID + " is due on " + ins.InsDueDate.Format("02/01/2006") + ", given:" + txn.TxnDate)
+		}
+		settlementMode = "anchor"
 	}
-	fmt.Println(string(response.GetPayload()))
-
 	//####################################################################################################################
-	//Calling for updating Bank Main_Wallet
+	//Calling for Business Loan Balance Update
 	//####################################################################################################################
-
-	cAmtString = args[5]
-	dAmtString = "0"
-
-	walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[7], "main", "bankcc", cAmtString, dAmtString)
+	// loanbalcc splits the repayment into the principal that clears what is
+	// disbursed and the refund of the rest to the borrower
+	loanBal := updateLoanBalRequest{LoanBalID: "1loanbal", LoanID: txn.LoanID, TxnID: txn.TxnID, TxnDate: txn.TxnDate, TxnType: txn.TxnType, Amt: txn.Amt, InsID: txn.InsID, Mode: "inst", PaidBy: txn.FromID, SettlementMode: settlementMode}
+	loanBalBytes, err := json.Marshal(loanBal)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"6", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode bank main")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
+	chaincodeArgs := toChaincodeArgs("updateLoanBal", string(loanBalBytes))
+	response := stub.InvokeChaincode("loanbalcc", chaincodeArgs, "myc")
 	if response.Status != shim.OK {
 		return shim.Error(response.Message)
 	}
-	fmt.Println(string(response.GetPayload()))
-
-	//####################################################################################################################
-	//Calling for updating Business Liability_Wallet
-	//####################################################################################################################
-
-	cAmtString = "0"
-	dAmtString = args[5]
-
-	walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[6], "liability", "businesscc", cAmtString, dAmtString)
+	repayment := updateLoanBalResult{}
+	err = json.Unmarshal(response.Payload, &repayment)
 	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"7", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode business liability")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+		return shim.Error("Invalid response from updateLoanBal (inst): " + err.Error())
 	}
-	fmt.Println(string(response.GetPayload()))
 
 	//####################################################################################################################
-	//Calling for Business Loan Balance Update
+	//Calling for moving the amount from Business Main_Wallet to the Bank Wallets
 	//####################################################################################################################
-	argsList = []string{"1loanbal", args[3], args[0], args[2], args[1], args[5], args[4], "inst"}
-	argsListString := strings.Join(argsList, ",")
-	chaincodeArgs = toChaincodeArgs("updateLoanBal", argsListString)
-	//sending to loanBalUp chaincode not loanBalance Chaincode
-	response = stub.InvokeChaincode("loanbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+	// All the legs are posted as one balanced journal in walletcc, which
+	// writes the TxnBalance rows of every leg
+	/*
+	 *	payer main wallet reduced by the repayment
+	 *	bank main wallet increased by the principal
+	 *	bank liability wallet increased by the refund owed to the borrower
+	 *	bank asset wallet reduced by the principal
+	 *	borrower loan wallet increased by the principal, clearing its debt
+	 *	in an AP settlement, supplier liability wallet increased and anchor
+	 *	liability wallet reduced by the principal, releasing the liability
+	 *	the supplier took on when it was paid early
+	 */
+	businessWalletID, err := getWalletIDonly(stub, "businesscc", txn.FromID, "main")
+	if err != nil {
+		return shim.Error("business main wallet (repayment) err : " + err.Error())
 	}
-	fmt.Println("Getting the payload from updateLoan bal (inst)")
-	payLoad := strings.Split(string(response.Payload), ",")
-
-	//payload[0] -> bankAssetVal
-	//payload[1] -> bankRefundVal
-	//payload[2] -> businessLoanVal
-
-	//####################################################################################################################
-	//4.Calling for updating Business Loan_Wallet
-	//####################################################################################################################
-
-	// Calling getSellerID (instrument) to get the seller ID
-
-	chaincodeArgs = toChaincodeArgs("getSellerID", args[4])
-	response = stub.InvokeChaincode("instrumentcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error("Error in getting the instrument id:" + response.Message)
+	bankWalletID, err := getWalletIDonly(stub, "bankcc", txn.ToID, "main")
+	if err != nil {
+		return shim.Error("bank main wallet (repayment) err : " + err.Error())
 	}
-
-	bus2ID := string(response.Payload)
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-
-	/*chaincodeArgs = toChaincodeArgs("getWalletID", bus2ID, "loan")
-	response = stub.InvokeChaincode("businesscc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error("Retreiving Business loan wallet in repayment " + response.Message)
-	}*/
-	walletID, err = getWalletIDonly(stub, "businesscc", bus2ID, "loan")
+	bankAssetWalletID, err := getWalletIDonly(stub, "bankcc", txn.ToID, "asset")
+	if err != nil {
+		return shim.Error("bank asset wallet (repayment) err : " + err.Error())
+	}
+	loanWalletID, err := getWalletIDonly(stub, "businesscc", borrowerID, "loan")
 	if err != nil {
 		return shim.Error("business loan wallet (repayment) err : " + err.Error())
 	}
 
-	walletArgs := toChaincodeArgs("updateWallet", walletID, payLoad[2])
-	walletResponse := stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error("Wallet updation Business loan wallet " + response.Message)
+	legs := []journalLeg{{businessWalletID, txn.Amt, 0}}
+	if repayment.PrincipalAmt > 0 {
+		legs = append(legs,
+			journalLeg{bankWalletID, 0, repayment.PrincipalAmt},
+			journalLeg{bankAssetWalletID, repayment.PrincipalAmt, 0},
+			journalLeg{loanWalletID, 0, repayment.PrincipalAmt},
+		)
 	}
-
-	argsList = []string{"6", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], cAmtString, dAmtString, txnBalString, args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+	if settlementMode == "anchor" && repayment.PrincipalAmt > 0 {
+		supplierLiabilityWalletID, err := getWalletIDonly(stub, "businesscc", borrowerID, "liability")
+		if err != nil {
+			return shim.Error("supplier liability wallet (repayment) err : " + err.Error())
+		}
+		anchorLiabilityWalletID, err := getWalletIDonly(stub, "businesscc", txn.FromID, "liability")
+		if err != nil {
+			return shim.Error("anchor liability wallet (repayment) err : " + err.Error())
+		}
+		legs = append(legs,
+			journalLeg{supplierLiabilityWalletID, 0, repayment.PrincipalAmt},
+			journalLeg{anchorLiabilityWalletID, repayment.PrincipalAmt, 0},
+		)
 	}
-	fmt.Println(string(response.GetPayload()))
-
-	//####################################################################################################################
-	//Calling for updating Bank Refund_Wallet
-	//####################################################################################################################
-
-	/*cAmtString = "0"
-	dAmtString = args[5]*/
-
-	/*walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[6], "refund", "bankcc", cAmtString, dAmtString)
-	if err != nil {
-		return shim.Error(err.Error())
-	}*/
-
-	/*chaincodeArgs = toChaincodeArgs("getWalletID", args[7], "liability")
-	response = stub.InvokeChaincode("bankcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error("Retreiving bank refund wallet in repayment " + response.Message)
-	}*/
-	walletID, err = getWalletIDonly(stub, "bankcc", args[7], "liability")
-	if err != nil {
-		return shim.Error("bank liability wallet (repayment) err : " + err.Error())
+	if repayment.RefundAmt > 0 {
+		bankLiabilityWalletID, err := getWalletIDonly(stub, "bankcc", txn.ToID, "liability")
+		if err != nil {
+			return shim.Error("bank liability wallet (repayment) err : " + err.Error())
+		}
+		legs = append(legs, journalLeg{bankLiabilityWalletID, 0, repayment.RefundAmt})
 	}
-
-	walletArgs = toChaincodeArgs("updateWallet", walletID, payLoad[1])
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error("Wallet updation bank refund wallet " + response.Message)
-	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"9", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], payLoad[1], "0", "500", args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode bank refund")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+	err = postJournal(stub, txn, legs)
+	if err != nil {
+		return shim.Error("wallets (repayment) err : " + err.Error())
 	}
-	fmt.Println(string(response.GetPayload()))
 
 	//####################################################################################################################
-	//Calling for updating Bank Asset Wallet
+	//Calling for Instrument Status Update
 	//####################################################################################################################
-
-	/*cAmtString = "0"
-	dAmtString = args[5]*/
-
-	/*walletID, openBalString, txnBalString, err = getWalletInfo(stub, args[6], "refund", "bankcc", cAmtString, dAmtString)
-	if err != nil {
-		return shim.Error(err.Error())
-	}*/
-
-	/*chaincodeArgs = toChaincodeArgs("getWalletID", args[7], "asset")
-	response = stub.InvokeChaincode("bankcc", chaincodeArgs, "myc")
-	if response.Status != shim.OK {
-		return shim.Error("Retreiving bank asset wallet in repayment " + response.Message)
-	}*/
-	walletID, err = getWalletIDonly(stub, "bankcc", args[7], "asset")
-	if err != nil {
-		return shim.Error("bank asset wallet (repayment) err : " + err.Error())
-	}
-	walletArgs = toChaincodeArgs("getWallet", walletID)
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error("getting wallet open bal in bank asset")
+	// The instrument is settled once the loan is collected, that is once the
+	// repayments add up to the instrument amount
+	insStatus := "part collected"
+	if repayment.LoanStatus == "collected" {
+		insStatus = "collected/settled"
 	}
-	openBalString = string(walletResponse.Payload)
-
-	walletArgs = toChaincodeArgs("updateWallet", walletID, payLoad[0])
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return shim.Error("Wallet updation bank asset wallet " + response.Message)
-	}
-
-	// STEP-4 generate txn_balance_object and write it to the Txn_Bal_Ledger
-	argsList = []string{"10", args[0], args[2], args[3], args[4], walletID, openBalString, args[1], args[5], "0", payLoad[0], "500", args[8]}
-	argsListStr = strings.Join(argsList, ",")
-	chaincodeArgs = toChaincodeArgs("putTxnInfo", argsListStr)
-	fmt.Println("calling the other chaincode bank asset")
-	response = stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
+	chaincodeArgs = toChaincodeArgs("updateInstrumentStatus", instID, insStatus)
+	response = stub.InvokeChaincode("instrumentcc", chaincodeArgs, "myc")
 	if response.Status != shim.OK {
-		return shim.Error(response.Message)
+		return shim.Error("Instrument " + txn.InsID + " (repayment):" + response.Message)
 	}
-	fmt.Println(string(response.GetPayload()))
 
 	//####################################################################################################################
 
 	return shim.Success(nil)
 }
 
-func getWalletInfo(stub shim.ChaincodeStubInterface, participantID string, walletType string, ccName string, cAmtStr string, dAmtStr string) (string, string, string, error) {
-
-	//STEP-1
-	// Getting wallet id from the chaincode
-	walletID, err := getWalletIDonly(stub, ccName, participantID, walletType)
-	if err != nil {
-		return "", "", "", err
-	}
-
-	// STEP-2
-	// getting Balance from walletID
-	// walletFcn := "getWallet"
-	walletArgs := toChaincodeArgs("getWallet", walletID)
-	walletResponse := stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return "", "", "", errors.New(walletResponse.Message)
-	}
-	openBalString := string(walletResponse.Payload)
-
-	openBal, err := strconv.ParseInt(openBalString, 10, 64)
-	if err != nil {
-		return "", "", "", errors.New("Error in converting the openBalance")
-	}
-	cAmt, err := strconv.ParseInt(cAmtStr, 10, 64)
-	if err != nil {
-		return "", "", "", errors.New("Error in converting the cAmt")
-	}
-	dAmt, err := strconv.ParseInt(dAmtStr, 10, 64)
-	if err != nil {
-		return "", "", "", errors.New("Error in converting the dAmt")
-	}
-
-	txnBal := openBal - dAmt + cAmt
-	txnBalString := strconv.FormatInt(txnBal, 10)
-
-	// STEP-3
-	// update wallet of ID walletID here, and write it to the wallet_ledger
-	// walletFcn := "updateWallet"
-
-	walletArgs = toChaincodeArgs("updateWallet", walletID, txnBalString)
-	walletResponse = stub.InvokeChaincode("walletcc", walletArgs, "myc")
-	if walletResponse.Status != shim.OK {
-		return "", "", "", errors.New(walletResponse.Message)
+func toChaincodeArgs(args ...string) [][]byte {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
 	}
+	return bargs
+}
 
-	return walletID, openBalString, txnBalString, nil
+// decodeRequest parses a JSON request from another chaincode, unknown fields are rejected
+func decodeRequest(reqStr string, req interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(reqStr))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(req)
 }
 
 func getWalletIDonly(stub shim.ChaincodeStubInterface, ccName string, id string, walletType string) (string, error) {
@@ -341,13 +295,66 @@ func getWalletIDonly(stub shim.ChaincodeStubInterface, ccName string, id string,
 	walletID := string(response.GetPayload())
 	return walletID, nil
 }
-func toChaincodeArgs(args ...string) [][]byte {
-	bargs := make([][]byte, len(args))
-	for i, arg := range args {
-		bargs[i] = []byte(arg)
+
+// getInstrumentProgram returns the instrumentID of the loan, its parties and
+// the type of its program (ar, ap or df). The instrument is found through the
+// loan since reference numbers are only unique per seller.
+func getInstrumentProgram(stub shim.ChaincodeStubInterface, txn txnRequest) (string, instrumentParties, string, error) {
+	ins := instrumentParties{}
+	chaincodeArgs := toChaincodeArgs("getLoanBalStatus", txn.LoanID)
+	response := stub.InvokeChaincode("loancc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return "", ins, "", errors.New(response.Message)
 	}
-	return bargs
+	loan := loanBalStatus{}
+	err := json.Unmarshal(response.Payload, &loan)
+	if err != nil {
+		return "", ins, "", errors.New("Unable to parse the loan " + txn.LoanID + ": " + err.Error())
+	}
+
+	chaincodeArgs = toChaincodeArgs("getInstrument", loan.InstNum)
+	response = stub.InvokeChaincode("instrumentcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return "", ins, "", errors.New(response.Message)
+	}
+	err = json.Unmarshal(response.Payload, &ins)
+	if err != nil {
+		return "", ins, "", errors.New("Unable to parse the instrument " + loan.InstNum + ": " + err.Error())
+	}
+	if ins.InstrumentRefNo != txn.InsID {
+		return "", ins, "", errors.New("Loan " + txn.LoanID + " is on instrument " + ins.InstrumentRefNo + ", given:" + txn.InsID)
+	}
+
+	chaincodeArgs = toChaincodeArgs("getProgram", ins.ProgramID)
+	response = stub.InvokeChaincode("programcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return "", ins, "", errors.New(response.Message)
+	}
+	program := programType{}
+	err = json.Unmarshal(response.Payload, &program)
+	if err != nil {
+		return "", ins, "", errors.New("Unable to parse the program " + ins.ProgramID + ": " + err.Error())
+	}
+	return loan.InstNum, ins, program.ProgramType, nil
 }
+
+// postJournal posts the legs of txn as one balanced journal in walletcc,
+// which also writes the TxnBalance rows of every leg
+func postJournal(stub shim.ChaincodeStubInterface, txn txnRequest, legs []journalLeg) error {
+	journal := journalRequest{txn.TxnID, txn.TxnDate, txn.LoanID, txn.InsID, txn.TxnType, txn.By, legs}
+	journalBytes, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	chaincodeArgs := toChaincodeArgs("postJournal", string(journalBytes))
+	response := stub.InvokeChaincode("walletcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
 func main() {
 	err := shim.Start(new(chainCode))
 	if err != nil {
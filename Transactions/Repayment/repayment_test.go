@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// fakeChaincode stands in for a peer chaincode, it answers each function
+// from responses and records the calls made to it. getWalletID answers
+// ownerID_role for any owner.
+type fakeChaincode struct {
+	responses map[string]pb.Response
+	calls     [][]string
+}
+
+func (f *fakeChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (f *fakeChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	f.calls = append(f.calls, append([]string{function}, args...))
+	if function == "getWalletID" {
+		return shim.Success([]byte(args[0] + "_" + args[1]))
+	}
+	response, ok := f.responses[function]
+	if !ok {
+		return shim.Error("No function named " + function)
+	}
+	return response
+}
+
+func (f *fakeChaincode) callsTo(function string) [][]string {
+	calls := [][]string{}
+	for _, call := range f.calls {
+		if call[0] == function {
+			calls = append(calls, call[1:])
+		}
+	}
+	return calls
+}
+
+func jsonSuccess(t *testing.T, v interface{}) pb.Response {
+	vBytes, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shim.Success(vBytes)
+}
+
+// newRepayStub returns a repayment chaincode with its peer chaincodes faked,
+// the loan L1 is on instrument INS1 (REF1) sold by the anchor to the dealer
+// under a program of progType and due on 01/06/2024. loanbalcc splits the
+// repayment as repayment.
+func newRepayStub(t *testing.T, progType string, repayment updateLoanBalResult) (*shim.MockStub, map[string]*fakeChaincode) {
+	stub := shim.NewMockStub("repaycc", new(chainCode))
+	dueDate := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	fakes := map[string]*fakeChaincode{
+		"loancc": {responses: map[string]pb.Response{
+			"getLoanBalStatus": jsonSuccess(t, loanBalStatus{LoanStatus: "disbursed", SanctionAmt: 600, InstNum: "INS1"}),
+		}},
+		"instrumentcc": {responses: map[string]pb.Response{
+			"getInstrument":          jsonSuccess(t, instrumentParties{"REF1", "anchor", "dealer", "P1", dueDate}),
+			"updateInstrumentStatus": shim.Success(nil),
+		}},
+		"programcc": {responses: map[string]pb.Response{
+			"getProgram": jsonSuccess(t, programType{progType}),
+		}},
+		"loanbalcc": {responses: map[string]pb.Response{
+			"updateLoanBal": jsonSuccess(t, repayment),
+		}},
+		"walletcc":   {responses: map[string]pb.Response{"postJournal": shim.Success(nil)}},
+		"bankcc":     {},
+		"businesscc": {},
+	}
+	for ccName, fake := range fakes {
+		stub.MockPeerChaincode(ccName+"/myc", shim.NewMockStub(ccName, fake))
+	}
+	return stub, fakes
+}
+
+func invokeRepay(t *testing.T, stub *shim.MockStub, txn txnRequest) pb.Response {
+	txnBytes, err := json.Marshal(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stub.MockInvoke("tx1", [][]byte{[]byte("newRepayInfo"), txnBytes})
+}
+
+func TestDFRepaymentFromDealer(t *testing.T) {
+	stub, fakes := newRepayStub(t, "df", updateLoanBalResult{"collected", 600, 100, 700})
+	// before the due date, only an AP settlement has to wait for it
+	txn := txnRequest{TxnID: "T2", TxnType: "repayment", TxnDate: "01/03/2024", LoanID: "L1", InsID: "REF1", Amt: 700, FromID: "dealer", ToID: "bank1"}
+
+	response := invokeRepay(t, stub, txn)
+	if response.Status != shim.OK {
+		t.Fatalf("repayment failed: %s", response.Message)
+	}
+
+	loanBals := fakes["loanbalcc"].callsTo("updateLoanBal")
+	if len(loanBals) != 1 {
+		t.Fatalf("want 1 loan balance update, got %d", len(loanBals))
+	}
+	loanBal := updateLoanBalRequest{}
+	err := json.Unmarshal([]byte(loanBals[0][0]), &loanBal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loanBal.Mode != "inst" || loanBal.Amt != 700 || loanBal.PaidBy != "dealer" || loanBal.SettlementMode != "direct" {
+		t.Errorf("want a direct repayment of 700 by the dealer, got %+v", loanBal)
+	}
+
+	journals := fakes["walletcc"].callsTo("postJournal")
+	if len(journals) != 1 {
+		t.Fatalf("want 1 journal, got %d", len(journals))
+	}
+	journal := journalRequest{}
+	err = json.Unmarshal([]byte(journals[0][0]), &journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []journalLeg{
+		{"dealer_main", 700, 0},
+		{"bank1_main", 0, 600},
+		{"bank1_asset", 600, 0},
+		{"dealer_loan", 0, 600},
+		{"bank1_liability", 0, 100},
+	}
+	if len(journal.Legs) != len(want) {
+		t.Fatalf("want legs %v, got %v", want, journal.Legs)
+	}
+	for i := range want {
+		if journal.Legs[i] != want[i] {
+			t.Errorf("leg %d: want %v, got %v", i+1, want[i], journal.Legs[i])
+		}
+	}
+
+	statuses := fakes["instrumentcc"].callsTo("updateInstrumentStatus")
+	if len(statuses) != 1 || statuses[0][0] != "INS1" || statuses[0][1] != "collected/settled" {
+		t.Errorf("want INS1 collected/settled, got %v", statuses)
+	}
+}
+
+func TestDFPartRepaymentKeepsInstrumentOpen(t *testing.T) {
+	stub, fakes := newRepayStub(t, "df", updateLoanBalResult{"part collected", 300, 0, 300})
+	txn := txnRequest{TxnID: "T2", TxnType: "repayment", TxnDate: "01/03/2024", LoanID: "L1", InsID: "REF1", Amt: 300, FromID: "dealer", ToID: "bank1"}
+
+	response := invokeRepay(t, stub, txn)
+	if response.Status != shim.OK {
+		t.Fatalf("repayment failed: %s", response.Message)
+	}
+	journal := journalRequest{}
+	err := json.Unmarshal([]byte(fakes["walletcc"].callsTo("postJournal")[0][0]), &journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journal.Legs) != 4 {
+		t.Errorf("want no refund leg, got %v", journal.Legs)
+	}
+	statuses := fakes["instrumentcc"].callsTo("updateInstrumentStatus")
+	if len(statuses) != 1 || statuses[0][1] != "part collected" {
+		t.Errorf("want INS1 part collected, got %v", statuses)
+	}
+}
+
+func TestDFRepaymentRejectsAnchor(t *testing.T) {
+	// The anchor repays in an AR program and settles in an AP program, in
+	// dealer finance the loan is the dealer's
+	for _, txnDate := range []string{"01/03/2024", "01/07/2024"} {
+		stub, fakes := newRepayStub(t, "df", updateLoanBalResult{"collected", 600, 0, 600})
+		txn := txnRequest{TxnID: "T2", TxnType: "repayment", TxnDate: txnDate, LoanID: "L1", InsID: "REF1", Amt: 600, FromID: "anchor", ToID: "bank1"}
+
+		response := invokeRepay(t, stub, txn)
+		if response.Status == shim.OK || !strings.Contains(response.Message, "dealer") {
+			t.Fatalf("want the anchor rejected on %s, got %d %s", txnDate, response.Status, response.Message)
+		}
+		if len(fakes["loanbalcc"].callsTo("updateLoanBal")) != 0 || len(fakes["walletcc"].callsTo("postJournal")) != 0 {
+			t.Errorf("nothing should be posted for a rejected repayment on %s", txnDate)
+		}
+	}
+}
+
+func TestAPSettlementWaitsForDueDate(t *testing.T) {
+	stub, fakes := newRepayStub(t, "ap", updateLoanBalResult{"collected", 600, 0, 600})
+	txn := txnRequest{TxnID: "T2", TxnType: "repayment", TxnDate: "01/03/2024", LoanID: "L1", InsID: "REF1", Amt: 600, FromID: "dealer", ToID: "bank1"}
+
+	response := invokeRepay(t, stub, txn)
+	if response.Status == shim.OK || !strings.Contains(response.Message, "due on 01/06/2024") {
+		t.Fatalf("want an early AP settlement rejected, got %d %s", response.Status, response.Message)
+	}
+	if len(fakes["walletcc"].callsTo("postJournal")) != 0 {
+		t.Error("no journal should be posted for a rejected settlement")
+	}
+}
+
+func TestAPSettlementReleasesSupplierLiability(t *testing.T) {
+	// In the stub the anchor program's seller is "anchor" and its buyer, who
+	// settles the supplier's loan on the due date, is "dealer"
+	stub, fakes := newRepayStub(t, "ap", updateLoanBalResult{"collected", 600, 0, 600})
+	txn := txnRequest{TxnID: "T2", TxnType: "repayment", TxnDate: "01/06/2024", LoanID: "L1", InsID: "REF1", Amt: 600, FromID: "dealer", ToID: "bank1"}
+
+	response := invokeRepay(t, stub, txn)
+	if response.Status != shim.OK {
+		t.Fatalf("settlement failed: %s", response.Message)
+	}
+
+	loanBal := updateLoanBalRequest{}
+	err := json.Unmarshal([]byte(fakes["loanbalcc"].callsTo("updateLoanBal")[0][0]), &loanBal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loanBal.PaidBy != "dealer" || loanBal.SettlementMode != "anchor" {
+		t.Errorf("want an anchor settlement paid by the buyer, got %+v", loanBal)
+	}
+
+	journals := fakes["walletcc"].callsTo("postJournal")
+	if len(journals) != 1 {
+		t.Fatalf("want 1 journal, got %d", len(journals))
+	}
+	journal := journalRequest{}
+	err = json.Unmarshal([]byte(journals[0][0]), &journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []journalLeg{
+		{"dealer_main", 600, 0},
+		{"bank1_main", 0, 600},
+		{"bank1_asset", 600, 0},
+		{"anchor_loan", 0, 600},
+		{"anchor_liability", 0, 600},
+		{"dealer_liability", 600, 0},
+	}
+	if len(journal.Legs) != len(want) {
+		t.Fatalf("want legs %v, got %v", want, journal.Legs)
+	}
+	for i := range want {
+		if journal.Legs[i] != want[i] {
+			t.Errorf("leg %d: want %v, got %v", i+1, want[i], journal.Legs[i])
+		}
+	}
+}
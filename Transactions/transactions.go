@@ -26,6 +26,20 @@ type transactionInfo struct {
 	PprID   string    //args[9]
 }
 
+// txnRequest is sent to newDisbInfo and newRepayInfo as JSON
+type txnRequest struct {
+	TxnID   string
+	TxnType string
+	TxnDate string // dd/mm/yyyy
+	LoanID  string
+	InsID   string
+	Amt     int64
+	FromID  string
+	ToID    string
+	By      string
+	PprID   string
+}
+
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
@@ -71,13 +85,17 @@ func newTxnInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error(err.Error())
 	}
 
+	txnReqBytes, err := json.Marshal(txnRequest{args[0], args[1], args[2], args[3], args[4], amt, args[6], args[7], args[8], args[9]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	//TODO: put it at last for redability
 
 	switch tTypeLower {
 
 	case "disbursement":
-		argsStr := strings.Join(args, ",")
-		chaincodeArgs := toChaincodeArgs("newDisbInfo", argsStr)
+		chaincodeArgs := toChaincodeArgs("newDisbInfo", string(txnReqBytes))
 		fmt.Println("calling the disbursement chaincode")
 		response := stub.InvokeChaincode("disbursementcc", chaincodeArgs, "myc")
 		if response.Status != shim.OK {
@@ -96,8 +114,7 @@ func newTxnInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		//chaincodeArgs = toChaincodeArgs("updateLoanBal",)
 
 	case "repayment":
-		argsStr := strings.Join(args, ",")
-		chaincodeArgs := toChaincodeArgs("newRepayInfo", argsStr)
+		chaincodeArgs := toChaincodeArgs("newRepayInfo", string(txnReqBytes))
 		fmt.Println("calling the repayment chaincode")
 		response := stub.InvokeChaincode("repaycc", chaincodeArgs, "myc")
 		if response.Status != shim.OK {
@@ -140,8 +157,11 @@ func getTxnInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error("error while unmarshaling:" + err.Error())
 	}
 
-	tString := fmt.Sprintf("%+v", transaction)
-	return shim.Success([]byte(tString))
+	txnBytes, err = json.Marshal(transaction)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(txnBytes)
 
 }
 
@@ -29,6 +29,23 @@ type txnBalanceInfo struct {
 	By         string
 }
 
+// txnBalRequest is the JSON request putTxnInfo accepts from other chaincodes
+type txnBalRequest struct {
+	TxnBalID   string
+	TxnID      string
+	TxnDate    string // dd/mm/yyyy
+	LoanID     string
+	InsID      string
+	WalletID   string
+	OpeningBal int64
+	TxnType    string
+	Amt        int64
+	CAmt       int64
+	DAmt       int64
+	TxnBal     int64
+	By         string
+}
+
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
@@ -39,30 +56,38 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return putTxnInfo(stub, args)
 	} else if function == "getTxnBalInfo" { // To view a Transaction Balance
 		return getTxnBalInfo(stub, args)
+	} else if function == "getTxnBalByWallet" { // All Transaction Balances of a wallet
+		return getTxnBalByWallet(stub, args)
 	}
 	return shim.Error("No function named " + function + " in TxnBalance")
 }
 
 func putTxnInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	if len(args) == 1 {
-		args = strings.Split(args[0], ",")
-	}
-	if len(args) != 13 {
+	/*
+	 *args[0] -> txnBalRequest as JSON
+	 */
+	if len(args) != 1 {
 		xLenStr := strconv.Itoa(len(args))
-		return shim.Error("Invalid number of arguments in putTxnInfo (required:13) given:" + xLenStr)
+		return shim.Error("Invalid number of arguments in putTxnInfo (required:1) given:" + xLenStr)
 	}
-	fmt.Println("Printing args")
-	fmt.Println(args)
-	//TxnDate ->txnDate
-	txnDate, err := time.Parse("02/01/2006", args[2])
+
+	req := txnBalRequest{}
+	err := decodeRequest(args[0], &req)
 	if err != nil {
-		return shim.Error("err in txndate " + err.Error())
+		return shim.Error("Invalid request in putTxnInfo: " + err.Error())
+	}
+	if req.TxnBalID == "" || req.TxnID == "" || req.WalletID == "" {
+		return shim.Error("TxnBalID, TxnID and WalletID are required in putTxnInfo")
+	}
+	if req.Amt < 0 || req.CAmt < 0 || req.DAmt < 0 {
+		return shim.Error("Amt, CAmt and DAmt cannot be negative in putTxnInfo")
 	}
 
-	openBal, err := strconv.ParseInt(args[6], 10, 64)
+	//TxnDate ->txnDate
+	txnDate, err := time.Parse("02/01/2006", req.TxnDate)
 	if err != nil {
-		return shim.Error("err in openbal " + err.Error())
+		return shim.Error("err in txndate " + err.Error())
 	}
 
 	txnTypeValues := map[string]bool{
@@ -73,54 +98,54 @@ func putTxnInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		"collection":          true,
 		"margin refund":       true,
 		"interest refund":     true,
+		"interest accrual":    true,
 		"tds":                 true,
 		"penal charges":       true,
 		"cersai carges":       true,
 		"factor regn charges": true,
+		"wallet update":       true,
 	}
 
-	txnTypeLower := strings.ToLower(args[7])
+	txnTypeLower := strings.ToLower(req.TxnType)
 	if !txnTypeValues[txnTypeLower] {
 		return shim.Error("Invalid Transaction type (TxnBalance):" + txnTypeLower)
 	}
 
-	amt, err := strconv.ParseInt(args[8], 10, 64)
-	if err != nil {
-		return shim.Error("err in amt(TxnBlance)" + err.Error())
+	ifExists, err := stub.GetState(req.TxnBalID)
+	if ifExists != nil {
+		return shim.Error("TxnBalanceId " + req.TxnBalID + " exits. Cannot create new ID")
 	}
 
-	cAmt, err := strconv.ParseInt(string(args[9]), 10, 64)
+	txnBalance := txnBalanceInfo{req.TxnID, txnDate, req.LoanID, req.InsID, req.WalletID, req.OpeningBal, txnTypeLower, req.Amt, req.CAmt, req.DAmt, req.TxnBal, req.By}
+	txnBalanceBytes, err := json.Marshal(txnBalance)
 	if err != nil {
-
-		return shim.Error("err in camt(TxnBlance)" + err.Error())
+		return shim.Error(err.Error())
 	}
-
-	dAmt, err := strconv.ParseInt(args[10], 10, 64)
+	err = stub.PutState(req.TxnBalID, txnBalanceBytes)
 	if err != nil {
-		return shim.Error("err in damt(TxnBlance) " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	txnBal, err := strconv.ParseInt(args[11], 10, 64)
+	// Index for looking up the rows of a wallet in date order. Within a date
+	// the rows follow the transaction time, written as fixed width nanoseconds
+	// so that the keys sort in time order. The TxnBalanceId is kept as the
+	// last attribute since one txn can have many rows.
+	ts, err := stub.GetTxTimestamp()
 	if err != nil {
-		return shim.Error("err in txnbal (TxnBlance)" + err.Error())
+		return shim.Error("Unable to get the transaction timestamp: " + err.Error())
 	}
-
-	ifExists, err := stub.GetState(args[0])
-	if ifExists != nil {
-		return shim.Error("TxnBalanceId " + args[0] + " exits. Cannot create new ID")
-	}
-
-	txnBalance := txnBalanceInfo{args[1], txnDate, args[3], args[4], args[5], openBal, txnTypeLower, amt, cAmt, dAmt, txnBal, args[12]}
-	txnBalanceBytes, err := json.Marshal(txnBalance)
+	txnTime := fmt.Sprintf("%020d", time.Unix(ts.Seconds, int64(ts.Nanos)).UnixNano())
+	walletDateKey, err := stub.CreateCompositeKey("walletID~date~txnTime", []string{txnBalance.WalletID, txnDate.Format("2006-01-02"), txnTime, req.TxnBalID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return shim.Error("Unable to create walletID~date~txnTime composite key:" + err.Error())
 	}
-	err = stub.PutState(args[0], txnBalanceBytes)
+	value := []byte{0x00}
+	err = stub.PutState(walletDateKey, value)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 	//fmt.Println("Transaction :", txnBalance)
-	fmt.Printf("Succefully wrote txnID %s into the ledger\n", args[0])
+	fmt.Printf("Succefully wrote txnID %s into the ledger\n", req.TxnBalID)
 
 	return shim.Success([]byte("Successful"))
 
@@ -148,9 +173,70 @@ func getTxnBalInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response
 		return shim.Error("Unable to parse TxnBalance into the structure " + err.Error())
 	}
 	//fmt.Println("Unmarshled TxnBalance function")
-	jsonString := fmt.Sprintf("%+v", txnBalance)
-	fmt.Printf("Transaction info %s : %s\n", args[0], jsonString)
-	return shim.Success(nil)
+	txnBalanceBytes, err = json.Marshal(txnBalance)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(txnBalanceBytes)
+}
+
+func getTxnBalByWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*
+	*Returns all the Transaction Balances of the wallet ordered by date and
+	*transaction time as JSON
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getTxnBalByWallet (required:1) given:" + xLenStr)
+	}
+
+	// The keys sort by date and then by transaction time
+	walletIterator, err := stub.GetStateByPartialCompositeKey("walletID~date~txnTime", []string{args[0]})
+	if err != nil {
+		return shim.Error("Unable to get the result for composite key : walletID~date~txnTime")
+	}
+	defer walletIterator.Close()
+
+	txnBalances := []txnBalanceInfo{}
+	for walletIterator.HasNext() {
+		walletData, err := walletIterator.Next()
+		if err != nil {
+			return shim.Error("Unable to iterate walletIterator:" + err.Error())
+		}
+		_, requiredArgs, err := stub.SplitCompositeKey(walletData.Key)
+		if err != nil {
+			return shim.Error("error spliting the composite key walletIterator:" + err.Error())
+		}
+		txnBalID := requiredArgs[3]
+		txnBalanceBytes, err := stub.GetState(txnBalID)
+		if err != nil {
+			return shim.Error("Failed to get the Transaction information: " + err.Error())
+		} else if txnBalanceBytes == nil {
+			return shim.Error("No information is avalilable on this TxnBalID " + txnBalID)
+		}
+		txnBalance := txnBalanceInfo{}
+		err = json.Unmarshal(txnBalanceBytes, &txnBalance)
+		if err != nil {
+			return shim.Error("Unable to parse TxnBalance into the structure " + err.Error())
+		}
+		txnBalances = append(txnBalances, txnBalance)
+	}
+
+	txnBalancesBytes, err := json.Marshal(txnBalances)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(txnBalancesBytes)
+}
+
+// decodeRequest parses a JSON request from another chaincode, unknown fields are rejected
+func decodeRequest(reqStr string, req interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(reqStr))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(req)
 }
 
 func main() {
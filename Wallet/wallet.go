@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -12,11 +16,179 @@ import (
 type chainCode struct {
 }
 
+// journalLeg is one side of a postJournal transfer. DAmt reduces and CAmt
+// increases the wallet balance, exactly one of them is set. A debit leg with a
+// HoldID is taken out of that hold of the wallet first.
+type journalLeg struct {
+	WalletID string
+	DAmt     int64
+	CAmt     int64
+	HoldID   string
+}
+
+// journalRequest is the JSON request postJournal accepts from other chaincodes
+type journalRequest struct {
+	TxnID   string
+	TxnDate string // dd/mm/yyyy
+	LoanID  string
+	InsID   string
+	TxnType string
+	By      string
+	Legs    []journalLeg
+}
+
+// txnBalRequest is sent to putTxnInfo in txnbalcc as JSON, creditWallet,
+// debitWallet, captureHold and updateWallet take it from their caller with the
+// transaction details only
+type txnBalRequest struct {
+	TxnBalID   string
+	TxnID      string
+	TxnDate    string // dd/mm/yyyy
+	LoanID     string
+	InsID      string
+	WalletID   string
+	OpeningBal int64
+	TxnType    string
+	Amt        int64
+	CAmt       int64
+	DAmt       int64
+	TxnBal     int64
+	By         string
+}
+
+// journalLegResult is returned by postJournal for every leg, and on its own
+// by creditWallet and debitWallet
+type journalLegResult struct {
+	WalletID string
+	OpenBal  int64
+	TxnBal   int64
+}
+
+// txnBalanceInfo is the Transaction Balance row as stored by txnbalcc
+type txnBalanceInfo struct {
+	TxnID      string
+	TxnDate    time.Time
+	LoanID     string
+	InsID      string
+	WalletID   string
+	OpeningBal int64
+	TxnType    string
+	Amt        int64
+	CAmt       int64
+	DAmt       int64
+	TxnBal     int64
+	By         string
+}
+
+type statementEntry struct {
+	TxnID   string
+	TxnDate time.Time
+	TxnType string
+	LoanID  string
+	InsID   string
+	CAmt    int64
+	DAmt    int64
+	TxnBal  int64
+}
+
+type walletStatement struct {
+	WalletID   string
+	FromDate   time.Time
+	ToDate     time.Time
+	OpeningBal int64
+	Entries    []statementEntry
+	ClosingBal int64
+}
+
+// holdInfo reserves Amount of a wallet till ExpiryDate without moving it,
+// stored against the walletID~holdID composite key
+type holdInfo struct {
+	WalletID   string
+	HoldID     string
+	Amount     int64
+	ExpiryDate time.Time
+	HoldStatus string // active, released or captured
+}
+
+// walletBalance is returned by getWallet
+type walletBalance struct {
+	Balance      int64 // ledger balance
+	HeldAmt      int64 // total of active holds
+	AvailableBal int64 // Balance - HeldAmt
+	WalletStatus string
+}
+
 type walletsInfo struct {
-	Balance int64
+	Balance         int64
+	OverdraftLimit  int64  // how far below zero a debit may take the wallet
+	WalletStatus    string // active, frozen, debit-frozen or closed
+	StatusReason    string
+	StatusChangedAt time.Time
+	StatusChangedBy string
+	OwnerType       string // bank, business or platform
+	OwnerID         string
+	WalletRole      string // one of the roles in the template of OwnerType
+}
+
+// walletTemplate lists the wallets created for an entity type on onboarding
+type walletTemplate struct {
+	EntityType string
+	Wallets    []templateWallet
+}
+
+type templateWallet struct {
+	WalletRole string
+	OpeningBal int64
+}
+
+// walletOwner is returned by getWalletOwner and listWalletsByOwner
+type walletOwner struct {
+	WalletID   string
+	OwnerType  string
+	OwnerID    string
+	WalletRole string
+}
+
+// Wallet roles a template of the entity type must have, the wallets of these
+// roles are looked up by the other chaincodes and kept on bankInfo and
+// businessInfo
+var requiredWalletRoles = map[string][]string{
+	"bank":     {"main", "asset", "charges", "liability", "tds"},
+	"business": {"main", "loan", "liability"},
+}
+
+// Reason codes accepted for a wallet status change
+var walletReasonCodes = map[string]bool{
+	"default":          true,
+	"fraud":            true,
+	"regulatory":       true,
+	"kyc pending":      true,
+	"customer request": true,
+	"settled":          true,
+	"other":            true,
 }
 
 func (c *chainCode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+
+	// Default templates, written only when the entity type has none yet so an
+	// upgrade keeps the templates set through setWalletTemplate
+	defaultTemplates := []walletTemplate{
+		{"bank", []templateWallet{{"main", 1000}, {"asset", 1000}, {"charges", 1000}, {"liability", 1000}, {"tds", 1000}}},
+		{"business", []templateWallet{{"main", 1000}, {"loan", 1000}, {"liability", 1000}}},
+	}
+	for _, template := range defaultTemplates {
+		_, exists, err := readWalletTemplate(stub, template.EntityType)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if exists {
+			continue
+		}
+		err = writeWalletTemplate(stub, template)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 	return shim.Success(nil)
 }
 
@@ -28,6 +200,36 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return getWallet(stub, args)
 	} else if function == "updateWallet" {
 		return updateWallet(stub, args)
+	} else if function == "creditWallet" {
+		return creditWallet(stub, args)
+	} else if function == "debitWallet" {
+		return debitWallet(stub, args)
+	} else if function == "postJournal" {
+		return postJournal(stub, args)
+	} else if function == "getWalletStatement" {
+		return getWalletStatement(stub, args)
+	} else if function == "placeHold" {
+		return placeHold(stub, args)
+	} else if function == "releaseHold" {
+		return releaseHold(stub, args)
+	} else if function == "captureHold" {
+		return captureHold(stub, args)
+	} else if function == "setWalletTemplate" {
+		return setWalletTemplate(stub, args)
+	} else if function == "getWalletTemplate" {
+		return getWalletTemplate(stub, args)
+	} else if function == "getWalletOwner" {
+		return getWalletOwner(stub, args)
+	} else if function == "listWalletsByOwner" {
+		return listWalletsByOwner(stub, args)
+	} else if function == "freezeWallet" {
+		return freezeWallet(stub, args)
+	} else if function == "unfreezeWallet" {
+		return unfreezeWallet(stub, args)
+	} else if function == "closeWallet" {
+		return closeWallet(stub, args)
+	} else if function == "setOverdraftLimit" {
+		return setOverdraftLimit(stub, args)
 	}
 	return shim.Error("No function named " + function + " in Wallet")
 
@@ -36,9 +238,17 @@ func (c *chainCode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 //Creating new Wallet
 
 func newWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 2 {
+	/*
+	*args[0] -> WalletID
+	*args[1] -> Opening Balance
+	*args[2] -> Owner Type (bank, business or platform)
+	*args[3] -> Owner ID
+	*args[4] -> Wallet Role, one of the roles in the template of the owner type
+	*args[5] -> Overdraft Limit (optional, defaults to 0)
+	 */
+	if len(args) != 5 && len(args) != 6 {
 		xLenStr := strconv.Itoa(len(args))
-		return shim.Error("Invalid number of arguments in newWallet (required:2) given:" + xLenStr)
+		return shim.Error("Invalid number of arguments in newWallet (required:5 or 6) given:" + xLenStr)
 	}
 
 	bal64, err := strconv.ParseInt(args[1], 10, 64)
@@ -46,14 +256,71 @@ func newWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		return shim.Error(err.Error())
 	}
 
+	ownerTypes := map[string]bool{
+		"bank":     true,
+		"business": true,
+		"platform": true,
+	}
+	ownerTypeLower := strings.ToLower(args[2])
+	if !ownerTypes[ownerTypeLower] {
+		return shim.Error("Invalid owner type " + args[2])
+	}
+	if args[3] == "" {
+		return shim.Error("Owner ID is required in newWallet")
+	}
+
+	template, exists, err := readWalletTemplate(stub, ownerTypeLower)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !exists {
+		return shim.Error("No wallet template for owner type " + ownerTypeLower)
+	}
+	walletRoleLower := strings.ToLower(args[4])
+	roleFound := false
+	for _, templateWallet := range template.Wallets {
+		if templateWallet.WalletRole == walletRoleLower {
+			roleFound = true
+			break
+		}
+	}
+	if !roleFound {
+		return shim.Error("Invalid wallet role " + args[4] + " for owner type " + ownerTypeLower)
+	}
+
+	var overdraft int64
+	if len(args) == 6 {
+		overdraft, err = strconv.ParseInt(args[5], 10, 64)
+		if err != nil {
+			return shim.Error("Invalid overdraft limit in newWallet: " + err.Error())
+		}
+		if overdraft < 0 {
+			return shim.Error("Overdraft limit cannot be negative in newWallet")
+		}
+	}
+
 	ifExists, err := stub.GetState(args[0])
 	if ifExists != nil {
 		return shim.Error("WalletId " + args[0] + " exits. Cannot create new ID")
 	}
 
-	bal := walletsInfo{bal64}
+	bal := walletsInfo{Balance: bal64, OverdraftLimit: overdraft, WalletStatus: "active", OwnerType: ownerTypeLower, OwnerID: args[3], WalletRole: walletRoleLower}
 	balBytes, _ := json.Marshal(bal)
 	err = stub.PutState(args[0], balBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	indexName := "ownerID~walletID"
+	ownerWalletKey, err := stub.CreateCompositeKey(indexName, []string{args[3], args[0]})
+	if err != nil {
+		return shim.Error("Unable to create ownerID~walletID composite key:" + err.Error())
+	}
+	value := []byte{0x00}
+	err = stub.PutState(ownerWalletKey, value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	return shim.Success(nil)
 }
 
@@ -62,22 +329,163 @@ func getWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		xLenStr := strconv.Itoa(len(args))
 		return shim.Error("Invalid number of arguments in getWallet (required:1) given: " + xLenStr)
 	}
-	balBytes, err := stub.GetState(args[0])
+	bal, err := readWallet(stub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
-	} else if balBytes == nil {
-		return shim.Error("No data exists on this WalletId: " + args[0])
 	}
-	bal := walletsInfo{}
-	err = json.Unmarshal(balBytes, &bal)
+	held, err := heldAmount(stub, args[0], "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Printf("Wallet %s : balance %d held %d\n", args[0], bal.Balance, held)
+
+	walletBal := walletBalance{bal.Balance, held, bal.Balance - held, walletStatus(bal)}
+	walletBalBytes, err := json.Marshal(walletBal)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	balString := fmt.Sprintf("%+v", bal)
-	fmt.Printf("Wallet %s : %s\n", args[0], balString)
+	return shim.Success(walletBalBytes)
+}
+
+func setWalletTemplate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> Entity Type (bank, business or platform)
+	*args[1] -> Wallets as JSON, [{"WalletRole":"main","OpeningBal":1000},..]
+	*
+	*Only the wallets onboarded after this call follow the new template. A
+	*bank template needs the main, asset, charges, liability and tds roles, a
+	*business template the main, loan and liability roles.
+	*The caller needs the role=admin attribute in its certificate.
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in setWalletTemplate (required:2) given: " + xLenStr)
+	}
+	err := checkAdmin(stub, "set the wallet template")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	entityTypes := map[string]bool{
+		"bank":     true,
+		"business": true,
+		"platform": true,
+	}
+	entityTypeLower := strings.ToLower(args[0])
+	if !entityTypes[entityTypeLower] {
+		return shim.Error("Invalid entity type " + args[0])
+	}
+
+	wallets := []templateWallet{}
+	err = json.Unmarshal([]byte(args[1]), &wallets)
+	if err != nil {
+		return shim.Error("Unable to parse the wallets in setWalletTemplate: " + err.Error())
+	}
+	if len(wallets) == 0 {
+		return shim.Error("Atleast one wallet is required in setWalletTemplate")
+	}
+	roles := map[string]bool{}
+	for i := range wallets {
+		wallets[i].WalletRole = strings.ToLower(strings.TrimSpace(wallets[i].WalletRole))
+		if wallets[i].WalletRole == "" {
+			return shim.Error("WalletRole missing in setWalletTemplate")
+		}
+		if roles[wallets[i].WalletRole] {
+			return shim.Error("Duplicate wallet role " + wallets[i].WalletRole + " in setWalletTemplate")
+		}
+		if wallets[i].OpeningBal < 0 {
+			return shim.Error("Opening balance cannot be negative for wallet role " + wallets[i].WalletRole)
+		}
+		roles[wallets[i].WalletRole] = true
+	}
+	for _, role := range requiredWalletRoles[entityTypeLower] {
+		if !roles[role] {
+			return shim.Error("Wallet role " + role + " is required in the " + entityTypeLower + " template, given:" + args[1])
+		}
+	}
+
+	err = writeWalletTemplate(stub, walletTemplate{entityTypeLower, wallets})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func getWalletTemplate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getWalletTemplate (required:1) given: " + xLenStr)
+	}
+	template, exists, err := readWalletTemplate(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !exists {
+		return shim.Error("No wallet template for entity type " + args[0])
+	}
+	templateBytes, err := json.Marshal(template)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(templateBytes)
+}
+
+func getWalletOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getWalletOwner (required:1) given: " + xLenStr)
+	}
+	bal, err := readWallet(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if bal.OwnerID == "" {
+		return shim.Error("No owner is recorded for WalletId: " + args[0])
+	}
+
+	owner := walletOwner{args[0], bal.OwnerType, bal.OwnerID, bal.WalletRole}
+	ownerBytes, err := json.Marshal(owner)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ownerBytes)
+}
+
+func listWalletsByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in listWalletsByOwner (required:1) given: " + xLenStr)
+	}
+
+	ownerIterator, err := stub.GetStateByPartialCompositeKey("ownerID~walletID", []string{args[0]})
+	if err != nil {
+		return shim.Error("Unable to get the result for composite key : ownerID~walletID")
+	}
+	defer ownerIterator.Close()
+
+	owners := []walletOwner{}
+	for ownerIterator.HasNext() {
+		ownerData, err := ownerIterator.Next()
+		if err != nil {
+			return shim.Error("Unable to iterate ownerIterator:" + err.Error())
+		}
+		_, requiredArgs, err := stub.SplitCompositeKey(ownerData.Key)
+		if err != nil {
+			return shim.Error("error spliting the composite key ownerIterator:" + err.Error())
+		}
+		bal, err := readWallet(stub, requiredArgs[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		owners = append(owners, walletOwner{requiredArgs[1], bal.OwnerType, bal.OwnerID, bal.WalletRole})
+	}
 
-	balStr := strconv.FormatInt(bal.Balance, 10)
-	return shim.Success([]byte(balStr))
+	ownersBytes, err := json.Marshal(owners)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(ownersBytes)
 }
 
 func updateWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -85,37 +493,957 @@ func updateWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	/*
 	*args[0] -> WalletID
 	*args[1] -> Wallet Ballance
+	*args[2] -> txnBalRequest as JSON (optional), as for creditWallet
+	*
+	*The change in balance is applied as a credit or debit of the difference,
+	*so a lower balance cannot take held funds or go past the overdraft limit.
+	*It is written into txnbalcc as a "wallet update" row of this transaction
+	*unless args[2] gives the transaction details.
+	 */
+	if len(args) != 2 && len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in Wallet Updation (required:2 or 3) given: " + xLenStr)
+	}
+	bal, err := readWallet(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	newBal, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return shim.Error("Error in Wallet updation parse int" + err.Error())
+	}
+
+	txnBal := txnBalRequest{}
+	if len(args) == 3 {
+		err = decodeRequest(args[2], &txnBal)
+		if err != nil {
+			return shim.Error("Invalid request in updateWallet: " + err.Error())
+		}
+	} else {
+		now, err := txnTime(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		by, err := cid.GetID(stub)
+		if err != nil {
+			return shim.Error("Unable to get the identity of the caller: " + err.Error())
+		}
+		txnBal = txnBalRequest{TxnBalID: stub.GetTxID() + "_" + args[0], TxnID: stub.GetTxID(), TxnDate: now.Format("02/01/2006"), TxnType: "wallet update", By: by}
+	}
+
+	openBal, closeBal, err := applyWalletAmt(stub, args[0], newBal-bal.Balance)
+	if err != nil {
+		return shim.Error("Wallet updation: " + err.Error())
+	}
+	err = putWalletTxnBal(stub, txnBal, args[0], openBal, closeBal)
+	if err != nil {
+		return shim.Error("Wallet updation: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func creditWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*args[1] -> Amount to be credited
+	*args[2] -> txnBalRequest as JSON, {"TxnBalID":"..","TxnID":"..","TxnDate":"..","TxnType":"..",..}
+	*
+	*The amount is written into txnbalcc as a Transaction Balance row, the
+	*wallet, amounts and balances of the row are filled in here.
+	*Returns journalLegResult as JSON, an amount of 0 leaves the wallet as it is
+	 */
+	if len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in creditWallet (required:3) given: " + xLenStr)
+	}
+	amt, err := parseWalletAmt(args[1])
+	if err != nil {
+		return shim.Error("creditWallet: " + err.Error())
+	}
+	txnBal := txnBalRequest{}
+	err = decodeRequest(args[2], &txnBal)
+	if err != nil {
+		return shim.Error("Invalid request in creditWallet: " + err.Error())
+	}
+	openBal, closeBal, err := applyWalletAmt(stub, args[0], amt)
+	if err != nil {
+		return shim.Error("creditWallet: " + err.Error())
+	}
+	err = putWalletTxnBal(stub, txnBal, args[0], openBal, closeBal)
+	if err != nil {
+		return shim.Error("creditWallet: " + err.Error())
+	}
+	resultBytes, err := json.Marshal(journalLegResult{args[0], openBal, closeBal})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultBytes)
+}
+
+func debitWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*args[1] -> Amount to be debited
+	*args[2] -> txnBalRequest as JSON, {"TxnBalID":"..","TxnID":"..","TxnDate":"..","TxnType":"..",..}
+	*
+	*The amount is written into txnbalcc as a Transaction Balance row, the
+	*wallet, amounts and balances of the row are filled in here.
+	*Returns journalLegResult as JSON, an amount of 0 leaves the wallet as it is
+	 */
+	if len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in debitWallet (required:3) given: " + xLenStr)
+	}
+	amt, err := parseWalletAmt(args[1])
+	if err != nil {
+		return shim.Error("debitWallet: " + err.Error())
+	}
+	txnBal := txnBalRequest{}
+	err = decodeRequest(args[2], &txnBal)
+	if err != nil {
+		return shim.Error("Invalid request in debitWallet: " + err.Error())
+	}
+	openBal, closeBal, err := applyWalletAmt(stub, args[0], -amt)
+	if err != nil {
+		return shim.Error("debitWallet: " + err.Error())
+	}
+	err = putWalletTxnBal(stub, txnBal, args[0], openBal, closeBal)
+	if err != nil {
+		return shim.Error("debitWallet: " + err.Error())
+	}
+	resultBytes, err := json.Marshal(journalLegResult{args[0], openBal, closeBal})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultBytes)
+}
+
+func setOverdraftLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*args[1] -> Overdraft Limit
 	 */
 	if len(args) != 2 {
 		xLenStr := strconv.Itoa(len(args))
-		return shim.Error("Invalid number of arguments in Wallet Updation (required:2) given: " + xLenStr)
+		return shim.Error("Invalid number of arguments in setOverdraftLimit (required:2) given: " + xLenStr)
+	}
+	limit, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return shim.Error("Invalid overdraft limit in setOverdraftLimit: " + err.Error())
+	}
+	if limit < 0 {
+		return shim.Error("Overdraft limit cannot be negative in setOverdraftLimit")
+	}
+
+	bal, err := readWallet(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if bal.Balance < -limit {
+		return shim.Error("Wallet " + args[0] + " is already overdrawn beyond the new limit")
+	}
+	bal.OverdraftLimit = limit
+
+	err = writeWallet(stub, args[0], bal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func freezeWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*args[1] -> Freeze Type, "full" stops every movement and "debit" only debits
+	*args[2] -> Reason Code
+	*
+	*The caller needs the role=admin attribute in its certificate.
+	 */
+	if len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in freezeWallet (required:3) given: " + xLenStr)
 	}
-	balBytes, err := stub.GetState(args[0])
+	err := checkAdmin(stub, "freeze a wallet")
 	if err != nil {
 		return shim.Error(err.Error())
-	} else if balBytes == nil {
-		return shim.Error("No data exists on this WalletId: " + args[0])
 	}
-	bal := walletsInfo{}
-	err = json.Unmarshal(balBytes, &bal)
+
+	freezeTypes := map[string]string{
+		"full":  "frozen",
+		"debit": "debit-frozen",
+	}
+	status, ok := freezeTypes[strings.ToLower(args[1])]
+	if !ok {
+		return shim.Error("Invalid freeze type " + args[1])
+	}
+
+	bal, err := readWallet(stub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if walletStatus(bal) == "closed" {
+		return shim.Error("Wallet " + args[0] + " is closed")
+	}
+	err = setWalletStatus(stub, args[0], bal, status, args[2])
+	if err != nil {
+		return shim.Error("freezeWallet: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func unfreezeWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	bal.Balance, err = strconv.ParseInt(args[1], 10, 64)
+	/*
+	*args[0] -> WalletID
+	*args[1] -> Reason Code
+	*
+	*The caller needs the role=admin attribute in its certificate.
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in unfreezeWallet (required:2) given: " + xLenStr)
+	}
+	err := checkAdmin(stub, "unfreeze a wallet")
 	if err != nil {
-		return shim.Error("Error in Wallet updation parse int" + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	balBytes, _ = json.Marshal(bal)
-	err = stub.PutState(args[0], balBytes)
+	bal, err := readWallet(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	status := walletStatus(bal)
+	if status != "frozen" && status != "debit-frozen" {
+		return shim.Error("Wallet " + args[0] + " is not frozen, status:" + status)
+	}
+	err = setWalletStatus(stub, args[0], bal, "active", args[1])
 	if err != nil {
-		return shim.Error("Error in Wallet updation " + err.Error())
+		return shim.Error("unfreezeWallet: " + err.Error())
 	}
-	fmt.Printf("Balance for %s : %d\n", args[0], bal.Balance)
 	return shim.Success(nil)
 }
 
+func closeWallet(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*args[1] -> Reason Code
+	*
+	*The caller needs the role=admin attribute in its certificate.
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in closeWallet (required:2) given: " + xLenStr)
+	}
+	err := checkAdmin(stub, "close a wallet")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	bal, err := readWallet(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if walletStatus(bal) == "closed" {
+		return shim.Error("Wallet " + args[0] + " is already closed")
+	}
+	if bal.Balance != 0 {
+		return shim.Error("Wallet " + args[0] + " cannot be closed with balance " + strconv.FormatInt(bal.Balance, 10))
+	}
+	held, err := heldAmount(stub, args[0], "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if held != 0 {
+		return shim.Error("Wallet " + args[0] + " cannot be closed with active holds of " + strconv.FormatInt(held, 10))
+	}
+	err = setWalletStatus(stub, args[0], bal, "closed", args[1])
+	if err != nil {
+		return shim.Error("closeWallet: " + err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func placeHold(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*args[1] -> HoldID
+	*args[2] -> Amount to be held
+	*args[3] -> Expiry Date (dd/mm/yyyy)
+	 */
+	if len(args) != 4 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in placeHold (required:4) given: " + xLenStr)
+	}
+	amt, err := parseWalletAmt(args[2])
+	if err != nil {
+		return shim.Error("placeHold: " + err.Error())
+	}
+	if amt == 0 {
+		return shim.Error("Hold amount should be greater than zero in placeHold")
+	}
+	expiryDate, err := time.Parse("02/01/2006", args[3])
+	if err != nil {
+		return shim.Error("Invalid expiry date in placeHold: " + err.Error())
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !expiryDate.After(now) {
+		return shim.Error("Expiry date of the hold " + args[1] + " has already passed")
+	}
+
+	bal, err := readWallet(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if walletStatus(bal) == "closed" {
+		return shim.Error("Wallet " + args[0] + " is closed")
+	}
+	hold, holdKey, err := readHold(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if hold.HoldID != "" {
+		return shim.Error("HoldID " + args[1] + " exits on wallet " + args[0] + ". Cannot create new hold")
+	}
+	held, err := heldAmount(stub, args[0], "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if bal.Balance-held-amt < -bal.OverdraftLimit {
+		return shim.Error("Insufficient available balance in wallet " + args[0] + " to hold " + args[2])
+	}
+
+	hold = holdInfo{args[0], args[1], amt, expiryDate, "active"}
+	err = writeHold(stub, holdKey, hold)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func releaseHold(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*args[1] -> HoldID
+	 */
+	if len(args) != 2 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in releaseHold (required:2) given: " + xLenStr)
+	}
+	// An expired hold no longer reserves anything but can still be released
+	hold, holdKey, err := readHold(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error("releaseHold: " + err.Error())
+	}
+	if hold.HoldID == "" {
+		return shim.Error("releaseHold: No hold " + args[1] + " on wallet " + args[0])
+	}
+	if hold.HoldStatus != "active" {
+		return shim.Error("releaseHold: Hold " + args[1] + " on wallet " + args[0] + " is already " + hold.HoldStatus)
+	}
+	hold.HoldStatus = "released"
+	err = writeHold(stub, holdKey, hold)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(nil)
+}
+
+func captureHold(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*args[1] -> HoldID
+	*args[2] -> txnBalRequest as JSON, as for debitWallet
+	*
+	*Debits the held amount from the wallet, writes it into txnbalcc and
+	*closes the hold. The matching credit is left to the caller as with
+	*debitWallet.
+	*Returns journalLegResult as JSON
+	 */
+	if len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in captureHold (required:3) given: " + xLenStr)
+	}
+	txnBal := txnBalRequest{}
+	err := decodeRequest(args[2], &txnBal)
+	if err != nil {
+		return shim.Error("Invalid request in captureHold: " + err.Error())
+	}
+	hold, holdKey, err := readActiveHold(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error("captureHold: " + err.Error())
+	}
+
+	bal, err := readWallet(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkWalletStatus(args[0], bal, true)
+	if err != nil {
+		return shim.Error("captureHold: " + err.Error())
+	}
+	// the captured hold is still counted in the ledger, so leave it out here
+	held, err := heldAmount(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	openBal := bal.Balance
+	bal.Balance = openBal - hold.Amount
+	if bal.Balance-held < -bal.OverdraftLimit {
+		return shim.Error("Insufficient balance in wallet " + args[0] + " to capture hold " + args[1])
+	}
+	err = writeWallet(stub, args[0], bal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = putWalletTxnBal(stub, txnBal, args[0], openBal, bal.Balance)
+	if err != nil {
+		return shim.Error("captureHold: " + err.Error())
+	}
+
+	hold.HoldStatus = "captured"
+	err = writeHold(stub, holdKey, hold)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	resultBytes, err := json.Marshal(journalLegResult{args[0], openBal, bal.Balance})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultBytes)
+}
+
+func postJournal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> journalRequest as JSON,
+	*           {"TxnID":"..","TxnDate":"..",..,"Legs":[{"WalletID":"..","DAmt":100,"CAmt":0},..]}
+	*
+	*Total DAmt of the legs should be equal to the total CAmt. Every leg is
+	*applied to its wallet and written into txnbalcc, if any leg fails the
+	*whole journal is rejected.
+	*
+	*A debit leg with a HoldID captures up to its amount from that hold, so
+	*the held funds pay for it.
+	 */
+	if len(args) != 1 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in postJournal (required:1) given: " + xLenStr)
+	}
+
+	journal := journalRequest{}
+	err := decodeRequest(args[0], &journal)
+	if err != nil {
+		return shim.Error("Invalid request in postJournal: " + err.Error())
+	}
+	if journal.TxnID == "" || journal.TxnDate == "" {
+		return shim.Error("TxnID and TxnDate are required in postJournal")
+	}
+	legs := journal.Legs
+	if len(legs) < 2 {
+		return shim.Error("postJournal requires atleast 2 legs, given:" + strconv.Itoa(len(legs)))
+	}
+
+	var totalDAmt, totalCAmt int64
+	for i, leg := range legs {
+		legNo := strconv.Itoa(i + 1)
+		if leg.WalletID == "" {
+			return shim.Error("WalletID missing in leg " + legNo + " of postJournal")
+		}
+		if leg.DAmt < 0 || leg.CAmt < 0 {
+			return shim.Error("Negative amount in leg " + legNo + " of postJournal")
+		}
+		if (leg.DAmt == 0) == (leg.CAmt == 0) {
+			return shim.Error("Either DAmt or CAmt should be given in leg " + legNo + " of postJournal")
+		}
+		totalDAmt += leg.DAmt
+		totalCAmt += leg.CAmt
+	}
+	if totalDAmt != totalCAmt {
+		return shim.Error("Journal is not balanced, total debit:" + strconv.FormatInt(totalDAmt, 10) + " total credit:" + strconv.FormatInt(totalCAmt, 10))
+	}
+
+	// The ledger does not return our own writes within a transaction, so
+	// every wallet is read once and the legs are applied in memory.
+	wallets := map[string]*walletsInfo{}
+	heldAmts := map[string]int64{}
+	holds := map[string]holdInfo{}
+	now, err := txnTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	results := make([]journalLegResult, len(legs))
+	for i, leg := range legs {
+		bal, ok := wallets[leg.WalletID]
+		if !ok {
+			walletBal, err := readWallet(stub, leg.WalletID)
+			if err != nil {
+				return shim.Error("Leg " + strconv.Itoa(i+1) + " of postJournal: " + err.Error())
+			}
+			heldAmts[leg.WalletID], err = heldAmount(stub, leg.WalletID, "")
+			if err != nil {
+				return shim.Error("Leg " + strconv.Itoa(i+1) + " of postJournal: " + err.Error())
+			}
+			bal = &walletBal
+			wallets[leg.WalletID] = bal
+		}
+		err = checkWalletStatus(leg.WalletID, *bal, leg.DAmt > 0)
+		if err != nil {
+			return shim.Error("Leg " + strconv.Itoa(i+1) + " of postJournal: " + err.Error())
+		}
+		if leg.HoldID != "" {
+			if leg.DAmt == 0 {
+				return shim.Error("HoldID given on the credit leg " + strconv.Itoa(i+1) + " of postJournal")
+			}
+			hold, holdKey, err := readHold(stub, leg.WalletID, leg.HoldID)
+			if err != nil {
+				return shim.Error("Leg " + strconv.Itoa(i+1) + " of postJournal: " + err.Error())
+			}
+			if prevHold, ok := holds[holdKey]; ok {
+				hold = prevHold
+			}
+			if hold.HoldID == "" {
+				return shim.Error("No hold " + leg.HoldID + " on wallet " + leg.WalletID + " for leg " + strconv.Itoa(i+1) + " of postJournal")
+			}
+			// A released, captured or expired hold reserves nothing, the
+			// leg is then taken from the available balance
+			if hold.HoldStatus == "active" && hold.ExpiryDate.After(now) {
+				captured := leg.DAmt
+				if captured > hold.Amount {
+					captured = hold.Amount
+				}
+				hold.Amount -= captured
+				if hold.Amount == 0 {
+					hold.HoldStatus = "captured"
+				}
+				heldAmts[leg.WalletID] -= captured
+				holds[holdKey] = hold
+			}
+		}
+		openBal := bal.Balance
+		bal.Balance = openBal - leg.DAmt + leg.CAmt
+		if leg.DAmt > 0 && bal.Balance-heldAmts[leg.WalletID] < -bal.OverdraftLimit {
+			return shim.Error("Insufficient balance in wallet " + leg.WalletID + " for leg " + strconv.Itoa(i+1) + " of postJournal")
+		}
+		results[i] = journalLegResult{leg.WalletID, openBal, bal.Balance}
+	}
+
+	for walletID, bal := range wallets {
+		err = writeWallet(stub, walletID, *bal)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	for holdKey, hold := range holds {
+		err = writeHold(stub, holdKey, hold)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	for i, leg := range legs {
+		txnBalID := journal.TxnID + "_" + strconv.Itoa(i+1)
+		txnBal := txnBalRequest{txnBalID, journal.TxnID, journal.TxnDate, journal.LoanID, journal.InsID, leg.WalletID, results[i].OpenBal, journal.TxnType, totalDAmt, leg.CAmt, leg.DAmt, results[i].TxnBal, journal.By}
+		err = putTxnBal(stub, txnBal)
+		if err != nil {
+			return shim.Error("Unable to write leg " + strconv.Itoa(i+1) + " of postJournal into txnbalcc: " + err.Error())
+		}
+	}
+
+	resultsBytes, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(resultsBytes)
+}
+
+func getWalletStatement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	/*
+	*args[0] -> WalletID
+	*args[1] -> From Date (dd/mm/yyyy)
+	*args[2] -> To Date (dd/mm/yyyy), inclusive
+	 */
+	if len(args) != 3 {
+		xLenStr := strconv.Itoa(len(args))
+		return shim.Error("Invalid number of arguments in getWalletStatement (required:3) given: " + xLenStr)
+	}
+
+	fromDate, err := time.Parse("02/01/2006", args[1])
+	if err != nil {
+		return shim.Error("Invalid from date in getWalletStatement: " + err.Error())
+	}
+	toDate, err := time.Parse("02/01/2006", args[2])
+	if err != nil {
+		return shim.Error("Invalid to date in getWalletStatement: " + err.Error())
+	}
+	if toDate.Before(fromDate) {
+		return shim.Error("To date is before from date in getWalletStatement")
+	}
+
+	bal, err := readWallet(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	chaincodeArgs := toChaincodeArgs("getTxnBalByWallet", args[0])
+	response := stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return shim.Error("Unable to get the transactions of wallet " + args[0] + ": " + response.Message)
+	}
+	txnBalances := []txnBalanceInfo{}
+	err = json.Unmarshal(response.Payload, &txnBalances)
+	if err != nil {
+		return shim.Error("Unable to parse the transactions of wallet " + args[0] + ": " + err.Error())
+	}
+
+	// The opening balance is worked back from the current balance through the
+	// rows from fromDate on, and every entry adds its legs to it. Nothing here
+	// depends on the order of rows written on the same day or in the same txn.
+	statement := walletStatement{WalletID: args[0], FromDate: fromDate, ToDate: toDate, Entries: []statementEntry{}}
+	statement.OpeningBal = bal.Balance
+	for _, txnBal := range txnBalances {
+		if !txnBal.TxnDate.Before(fromDate) {
+			statement.OpeningBal -= txnBal.CAmt - txnBal.DAmt
+		}
+	}
+
+	statement.ClosingBal = statement.OpeningBal
+	for _, txnBal := range txnBalances {
+		if txnBal.TxnDate.Before(fromDate) || txnBal.TxnDate.After(toDate) {
+			continue
+		}
+		statement.ClosingBal += txnBal.CAmt - txnBal.DAmt
+		statement.Entries = append(statement.Entries, statementEntry{txnBal.TxnID, txnBal.TxnDate, txnBal.TxnType, txnBal.LoanID, txnBal.InsID, txnBal.CAmt, txnBal.DAmt, statement.ClosingBal})
+	}
+
+	statementBytes, err := json.Marshal(statement)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(statementBytes)
+}
+
+// applyWalletAmt adds amt (negative for a debit) to the wallet balance and
+// returns the balance before and after. A debit is refused if it would take
+// the wallet below its overdraft limit.
+func applyWalletAmt(stub shim.ChaincodeStubInterface, walletID string, amt int64) (int64, int64, error) {
+	bal, err := readWallet(stub, walletID)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = checkWalletStatus(walletID, bal, amt < 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	openBal := bal.Balance
+	if amt == 0 {
+		return openBal, openBal, nil
+	}
+	closeBal := openBal + amt
+	if amt < 0 {
+		// funds under hold are not available for a debit
+		held, err := heldAmount(stub, walletID, "")
+		if err != nil {
+			return 0, 0, err
+		}
+		if closeBal-held < -bal.OverdraftLimit {
+			return 0, 0, errors.New("Insufficient balance in wallet " + walletID + " (balance:" + strconv.FormatInt(openBal, 10) + " held:" + strconv.FormatInt(held, 10) + " overdraft limit:" + strconv.FormatInt(bal.OverdraftLimit, 10) + " debit:" + strconv.FormatInt(-amt, 10) + ")")
+		}
+	}
+	bal.Balance = closeBal
+
+	err = writeWallet(stub, walletID, bal)
+	if err != nil {
+		return 0, 0, err
+	}
+	fmt.Printf("Balance for %s : %d -> %d\n", walletID, openBal, closeBal)
+	return openBal, closeBal, nil
+}
+
+// putWalletTxnBal writes the Transaction Balance row of a balance moved
+// from openBal to closeBal outside postJournal, the caller's txnBal gives the
+// transaction details. Nothing is written when the balance did not move.
+func putWalletTxnBal(stub shim.ChaincodeStubInterface, txnBal txnBalRequest, walletID string, openBal int64, closeBal int64) error {
+	if closeBal == openBal {
+		return nil
+	}
+	txnBal.WalletID = walletID
+	txnBal.OpeningBal = openBal
+	txnBal.TxnBal = closeBal
+	txnBal.CAmt, txnBal.DAmt = 0, 0
+	if closeBal > openBal {
+		txnBal.CAmt = closeBal - openBal
+	} else {
+		txnBal.DAmt = openBal - closeBal
+	}
+	if txnBal.Amt == 0 {
+		txnBal.Amt = txnBal.CAmt + txnBal.DAmt
+	}
+	return putTxnBal(stub, txnBal)
+}
+
+// putTxnBal writes a Transaction Balance row through txnbalcc
+func putTxnBal(stub shim.ChaincodeStubInterface, txnBal txnBalRequest) error {
+	txnBalBytes, err := json.Marshal(txnBal)
+	if err != nil {
+		return err
+	}
+	chaincodeArgs := toChaincodeArgs("putTxnInfo", string(txnBalBytes))
+	response := stub.InvokeChaincode("txnbalcc", chaincodeArgs, "myc")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+func readWalletTemplate(stub shim.ChaincodeStubInterface, entityType string) (walletTemplate, bool, error) {
+	template := walletTemplate{}
+	templateKey, err := stub.CreateCompositeKey("walletTemplate", []string{entityType})
+	if err != nil {
+		return template, false, errors.New("Unable to create walletTemplate composite key:" + err.Error())
+	}
+	templateBytes, err := stub.GetState(templateKey)
+	if err != nil {
+		return template, false, err
+	} else if templateBytes == nil {
+		return template, false, nil
+	}
+	err = json.Unmarshal(templateBytes, &template)
+	if err != nil {
+		return template, false, errors.New("Unable to parse the wallet template of " + entityType + ": " + err.Error())
+	}
+	return template, true, nil
+}
+
+func writeWalletTemplate(stub shim.ChaincodeStubInterface, template walletTemplate) error {
+	templateKey, err := stub.CreateCompositeKey("walletTemplate", []string{template.EntityType})
+	if err != nil {
+		return errors.New("Unable to create walletTemplate composite key:" + err.Error())
+	}
+	templateBytes, err := json.Marshal(template)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(templateKey, templateBytes)
+}
+
+// walletStatus treats wallets written before statuses existed as active
+func walletStatus(bal walletsInfo) string {
+	if bal.WalletStatus == "" {
+		return "active"
+	}
+	return bal.WalletStatus
+}
+
+// checkWalletStatus refuses a debit or credit that the wallet status forbids
+func checkWalletStatus(walletID string, bal walletsInfo, isDebit bool) error {
+	status := walletStatus(bal)
+	if status == "active" || (status == "debit-frozen" && !isDebit) {
+		return nil
+	}
+	movement := "credit"
+	if isDebit {
+		movement = "debit"
+	}
+	return errors.New("Wallet " + walletID + " is " + status + " (" + bal.StatusReason + "), cannot " + movement)
+}
+
+// setWalletStatus records the new status along with who changed it and when
+func setWalletStatus(stub shim.ChaincodeStubInterface, walletID string, bal walletsInfo, status string, reasonCode string) error {
+	reasonLower := strings.ToLower(reasonCode)
+	if !walletReasonCodes[reasonLower] {
+		return errors.New("Invalid reason code " + reasonCode)
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return err
+	}
+	changedBy, err := cid.GetID(stub)
+	if err != nil {
+		return errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+
+	bal.WalletStatus = status
+	bal.StatusReason = reasonLower
+	bal.StatusChangedAt = now
+	bal.StatusChangedBy = changedBy
+	err = writeWallet(stub, walletID, bal)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wallet %s is %s (%s)\n", walletID, status, reasonLower)
+	return nil
+}
+
+// heldAmount is the total of the active, unexpired holds on the wallet,
+// leaving out excludeHoldID
+func heldAmount(stub shim.ChaincodeStubInterface, walletID string, excludeHoldID string) (int64, error) {
+	now, err := txnTime(stub)
+	if err != nil {
+		return 0, err
+	}
+	holdIterator, err := stub.GetStateByPartialCompositeKey("walletID~holdID", []string{walletID})
+	if err != nil {
+		return 0, errors.New("Unable to get the result for composite key : walletID~holdID")
+	}
+	defer holdIterator.Close()
+
+	var held int64
+	for holdIterator.HasNext() {
+		holdData, err := holdIterator.Next()
+		if err != nil {
+			return 0, errors.New("Unable to iterate holdIterator:" + err.Error())
+		}
+		hold := holdInfo{}
+		err = json.Unmarshal(holdData.Value, &hold)
+		if err != nil {
+			return 0, errors.New("Unable to parse the hold " + holdData.Key + ": " + err.Error())
+		}
+		if hold.HoldStatus != "active" || !hold.ExpiryDate.After(now) || hold.HoldID == excludeHoldID {
+			continue
+		}
+		held += hold.Amount
+	}
+	return held, nil
+}
+
+// readHold returns an empty holdInfo if the hold does not exist
+func readHold(stub shim.ChaincodeStubInterface, walletID string, holdID string) (holdInfo, string, error) {
+	hold := holdInfo{}
+	holdKey, err := stub.CreateCompositeKey("walletID~holdID", []string{walletID, holdID})
+	if err != nil {
+		return hold, "", errors.New("Unable to create walletID~holdID composite key:" + err.Error())
+	}
+	holdBytes, err := stub.GetState(holdKey)
+	if err != nil {
+		return hold, "", err
+	} else if holdBytes == nil {
+		return hold, holdKey, nil
+	}
+	err = json.Unmarshal(holdBytes, &hold)
+	if err != nil {
+		return hold, "", err
+	}
+	return hold, holdKey, nil
+}
+
+func readActiveHold(stub shim.ChaincodeStubInterface, walletID string, holdID string) (holdInfo, string, error) {
+	hold, holdKey, err := readHold(stub, walletID, holdID)
+	if err != nil {
+		return hold, "", err
+	}
+	if hold.HoldID == "" {
+		return hold, "", errors.New("No hold " + holdID + " on wallet " + walletID)
+	}
+	if hold.HoldStatus != "active" {
+		return hold, "", errors.New("Hold " + holdID + " on wallet " + walletID + " is already " + hold.HoldStatus)
+	}
+	now, err := txnTime(stub)
+	if err != nil {
+		return hold, "", err
+	}
+	if !hold.ExpiryDate.After(now) {
+		return hold, "", errors.New("Hold " + holdID + " on wallet " + walletID + " has expired")
+	}
+	return hold, holdKey, nil
+}
+
+func writeHold(stub shim.ChaincodeStubInterface, holdKey string, hold holdInfo) error {
+	holdBytes, err := json.Marshal(hold)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(holdKey, holdBytes)
+}
+
+// checkAdmin fails unless the caller has the role=admin attribute in its
+// certificate, action says what the caller tried to do
+func checkAdmin(stub shim.ChaincodeStubInterface, action string) error {
+	role, found, err := cid.GetAttributeValue(stub, "role")
+	if err != nil {
+		return errors.New("Unable to get the identity of the caller: " + err.Error())
+	}
+	if !found || role != "admin" {
+		return errors.New("Only an admin can " + action)
+	}
+	return nil
+}
+
+// txnTime is the timestamp of the transaction, same on every endorser
+func txnTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errors.New("Unable to get the transaction timestamp: " + err.Error())
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+func parseWalletAmt(amtStr string) (int64, error) {
+	amt, err := strconv.ParseInt(amtStr, 10, 64)
+	if err != nil {
+		return 0, errors.New("Invalid amount " + amtStr)
+	}
+	if amt < 0 {
+		return 0, errors.New("Amount cannot be negative, given:" + amtStr)
+	}
+	return amt, nil
+}
+
+func readWallet(stub shim.ChaincodeStubInterface, walletID string) (walletsInfo, error) {
+	bal := walletsInfo{}
+	balBytes, err := stub.GetState(walletID)
+	if err != nil {
+		return bal, err
+	} else if balBytes == nil {
+		return bal, errors.New("No data exists on this WalletId: " + walletID)
+	}
+	err = json.Unmarshal(balBytes, &bal)
+	if err != nil {
+		return bal, err
+	}
+	return bal, nil
+}
+
+func writeWallet(stub shim.ChaincodeStubInterface, walletID string, bal walletsInfo) error {
+	balBytes, err := json.Marshal(bal)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(walletID, balBytes)
+	if err != nil {
+		return errors.New("Error in Wallet updation " + err.Error())
+	}
+	return nil
+}
+
+// decodeRequest parses a JSON request from another chaincode, unknown fields are rejected
+func decodeRequest(reqStr string, req interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(reqStr))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(req)
+}
+
+func toChaincodeArgs(args ...string) [][]byte {
+	bargs := make([][]byte, len(args))
+	for i, arg := range args {
+		bargs[i] = []byte(arg)
+	}
+	return bargs
+}
+
 func main() {
 	err := shim.Start(new(chainCode))
 	if err != nil {